@@ -0,0 +1,80 @@
+package datadog
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+// tcpWriter is a statsd transport over a TCP connection
+type tcpWriter struct {
+	net.Conn
+}
+
+func (w tcpWriter) SetWriteTimeout(time.Duration) error {
+	return nil
+}
+
+func TestReporter_CloseWithBlockingFlush(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	received := make(chan string)
+	go func() {
+		cn, err := ln.Accept()
+		if err != nil {
+			close(received)
+			return
+		}
+		defer cn.Close()
+
+		b, _ := io.ReadAll(cn)
+		received <- string(b)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	cn, err := statsd.NewWithWriter(tcpWriter{conn}, statsd.WithoutTelemetry())
+	assert.NoError(t, err)
+
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredCounter("foo", r).Inc(3)
+	metrics.NewRegisteredGauge("bar", r).Update(7)
+
+	dd, _ := New(WithClient(cn), WithRegistry(r), WithBlockingFlush(true))
+	go dd.FlushWithInterval(time.Hour)
+	assert.NoError(t, dd.Close())
+
+	select {
+	case d := <-received:
+		assert.Contains(t, d, "foo:3|c\n")
+		assert.Contains(t, d, "bar:7|g\n")
+	case <-time.After(time.Second):
+		assert.Fail(t, "timeout")
+	}
+}
+
+func TestReporter_Close(t *testing.T) {
+	dd, _ := New(WithClient(&statsd.NoOpClient{}))
+
+	done := make(chan struct{})
+	go func() {
+		dd.FlushWithInterval(time.Millisecond)
+		close(done)
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+	assert.NoError(t, dd.Close())
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "FlushWithInterval didn't return")
+	}
+}
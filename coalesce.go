@@ -0,0 +1,54 @@
+package datadog
+
+import (
+	"sort"
+	"strings"
+)
+
+// pendingGauge is a gauge buffered until the end of a flush
+type pendingGauge struct {
+	name  string
+	value float64
+	tags  []string
+}
+
+// buffer records a gauge to be sent at the end of the flush, combining it with
+// any gauge of the same series already buffered
+func (r *Reporter) buffer(name string, v float64, tags []string) {
+	key := seriesKey(name, tags)
+
+	if i, ok := r.series[key]; ok {
+		if r.reduce != nil {
+			v = r.reduce(r.pending[i].value, v)
+		}
+		r.pending[i].value = v
+		return
+	}
+
+	if r.series == nil {
+		r.series = make(map[string]int)
+	}
+	r.series[key] = len(r.pending)
+	r.pending = append(r.pending, pendingGauge{name, v, tags})
+}
+
+// drain sends the buffered gauges, in the order their series were first seen
+func (r *Reporter) drain() {
+	for _, g := range r.pending {
+		r.sendGauge(g.name, g.value, g.tags)
+	}
+
+	r.pending = r.pending[:0]
+	for key := range r.series {
+		delete(r.series, key)
+	}
+}
+
+// seriesKey identifies the series of a metric by its name and sorted tags
+func seriesKey(name string, tags []string) string {
+	sorted := make([]string, len(tags))
+	copy(sorted, tags)
+	sort.Strings(sorted)
+
+	return name + "|#" + strings.Join(sorted, ",")
+}
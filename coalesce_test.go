@@ -0,0 +1,42 @@
+package datadog
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReporter_FlushWithEmissionBuffer(t *testing.T) {
+	// The registries are scanned in order, so foo.count is 1, 5 then 3
+	a, b, c := metrics.NewRegistry(), metrics.NewRegistry(), metrics.NewRegistry()
+	metrics.NewRegisteredTimer("foo", a).Update(time.Millisecond)
+	metrics.NewRegisteredGauge("foo.count", b).Update(5)
+	metrics.NewRegisteredGauge("foo.count", c).Update(3)
+
+	for _, tt := range []struct {
+		reduce func(prev, v float64) float64
+		e      string
+	}{
+		{nil, "foo.count:3|g\n"},
+		{math.Max, "foo.count:5|g\n"},
+		{math.Min, "foo.count:1|g\n"},
+	} {
+		var buf bytes.Buffer
+		dd, _ := New(WithClient(&statsd.NoOpClient{}), WithRegistries(a, b, c),
+			WithPercentiles(nil), WithFileSink(&buf), WithEmissionBuffer(tt.reduce))
+		dd.Flush()
+
+		assert.Equal(t, 1, bytes.Count(buf.Bytes(), []byte("foo.count:")))
+		assert.Contains(t, buf.String(), tt.e)
+	}
+}
+
+func TestSeriesKey(t *testing.T) {
+	assert.Equal(t, seriesKey("foo", []string{"b:2", "a:1"}), seriesKey("foo", []string{"a:1", "b:2"}))
+	assert.NotEqual(t, seriesKey("foo", []string{"a:1"}), seriesKey("foo", []string{"a:2"}))
+}
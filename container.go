@@ -0,0 +1,60 @@
+package datadog
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+)
+
+// The files from which the container ID is read. With cgroup v2 the cgroup of
+// the process is often just "/", and the ID is found in the paths of mounts
+// made by the container runtime.
+var (
+	cgroupPath    = "/proc/self/cgroup"
+	mountInfoPath = "/proc/self/mountinfo"
+)
+
+const (
+	uuidSource      = `[0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12}`
+	containerSource = `[0-9a-f]{64}`
+	taskSource      = `[0-9a-f]{32}-\d+`
+)
+
+var (
+	// cgroupLine matches a line of /proc/self/cgroup ending with a container
+	// ID, such as 0::/docker/<id> or a systemd docker-<id>.scope
+	cgroupLine = regexp.MustCompile(`^\d+:[^:]*:.*[/-](` + uuidSource + `|` + containerSource + `|` + taskSource + `)(?:\.scope)?$`)
+
+	// mountInfoLine matches a line of /proc/self/mountinfo for a file mounted
+	// from the directory of a container, such as its /etc/hostname
+	mountInfoLine = regexp.MustCompile(`/containers/(` + containerSource + `)/`)
+)
+
+// containerID returns the ID of the container running the process, or an empty
+// string outside of containers
+func containerID() string {
+	if id := scanFile(cgroupPath, cgroupLine); id != "" {
+		return id
+	}
+
+	return scanFile(mountInfoPath, mountInfoLine)
+}
+
+// scanFile returns the first submatch of re in the lines of the named file, or
+// an empty string when none match or the file can't be read
+func scanFile(name string, re *regexp.Regexp) string {
+	f, err := os.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if m := re.FindStringSubmatch(scanner.Text()); m != nil {
+			return m[1]
+		}
+	}
+
+	return ""
+}
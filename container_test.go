@@ -0,0 +1,84 @@
+package datadog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testContainerID = "3726184226f5d3147c25fdeab5b60097e378e8a720503a5e19ecfdf29f869860"
+
+// withProcFiles points the cgroup files at files with the given contents for
+// the duration of the test
+func withProcFiles(t *testing.T, cgroup, mountInfo string) {
+	dir := t.TempDir()
+	oldCgroup, oldMountInfo := cgroupPath, mountInfoPath
+	cgroupPath, mountInfoPath = filepath.Join(dir, "cgroup"), filepath.Join(dir, "mountinfo")
+	t.Cleanup(func() { cgroupPath, mountInfoPath = oldCgroup, oldMountInfo })
+
+	assert.NoError(t, os.WriteFile(cgroupPath, []byte(cgroup), 0o644))
+	assert.NoError(t, os.WriteFile(mountInfoPath, []byte(mountInfo), 0o644))
+}
+
+func TestContainerID(t *testing.T) {
+	for name, tt := range map[string]struct {
+		cgroup, mountInfo, e string
+	}{
+		"cgroup v1": {
+			cgroup: "12:memory:/docker/" + testContainerID + "\n11:cpu:/docker/" + testContainerID + "\n",
+			e:      testContainerID,
+		},
+		"systemd": {
+			cgroup: "1:name=systemd:/system.slice/docker-" + testContainerID + ".scope\n",
+			e:      testContainerID,
+		},
+		"kubernetes": {
+			cgroup: "0::/kubepods/besteffort/pod3d274242-8ee0-11e9-a8a6-1e68d864ef1a/" + testContainerID + "\n",
+			e:      testContainerID,
+		},
+		"cgroup v2": {
+			cgroup:    "0::/\n",
+			mountInfo: "2930 2917 0:36 /var/lib/docker/containers/" + testContainerID + "/hostname /etc/hostname rw,relatime - ext4 /dev/sda1 rw\n",
+			e:         testContainerID,
+		},
+		"host": {
+			cgroup:    "12:memory:/user.slice\n0::/init.scope\n",
+			mountInfo: "22 1 8:1 / / rw,relatime - ext4 /dev/sda1 rw\n",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			withProcFiles(t, tt.cgroup, tt.mountInfo)
+			assert.Equal(t, tt.e, containerID())
+		})
+	}
+}
+
+func TestContainerID_NoFiles(t *testing.T) {
+	oldCgroup, oldMountInfo := cgroupPath, mountInfoPath
+	cgroupPath, mountInfoPath = "/nonexistent/cgroup", "/nonexistent/mountinfo"
+	defer func() { cgroupPath, mountInfoPath = oldCgroup, oldMountInfo }()
+
+	assert.Equal(t, "", containerID())
+}
+
+func TestReporter_FlushWithContainerTag(t *testing.T) {
+	withProcFiles(t, "0::/docker/"+testContainerID+"\n", "")
+
+	dd, buf := newTestReporter(t, newRegistryWithCounter("foo", 1), WithContainerTag(true))
+	dd.Flush()
+
+	assert.Equal(t, "foo:1|c|#container_id:"+testContainerID+"\n", buf.String())
+}
+
+func TestReporter_FlushWithKubernetesTags(t *testing.T) {
+	t.Setenv("POD_NAME", "api-7d9f")
+	t.Setenv("POD_NAMESPACE", "prod")
+	t.Setenv("NODE_NAME", "")
+
+	dd, buf := newTestReporter(t, newRegistryWithCounter("foo", 1), WithKubernetesTags())
+	dd.Flush()
+
+	assert.Equal(t, "foo:1|c|#pod_name:api-7d9f,kube_namespace:prod\n", buf.String())
+}
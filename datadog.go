@@ -1,9 +1,23 @@
 package datadog
 
 import (
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/DataDog/datadog-go/statsd"
 	"github.com/rcrowley/go-metrics"
@@ -11,6 +25,126 @@ import (
 
 type configFn func(r *Reporter)
 
+// Logger is the interface used by the reporter to log problems. It is
+// satisfied by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// CounterMode determines how counters are reported to Datadog
+type CounterMode int
+
+const (
+	// CounterDelta reports the change since the previous flush as a count
+	CounterDelta CounterMode = iota
+
+	// CounterDeltaGauge reports the change since the previous flush as a
+	// gauge, so Datadog applies no count semantics of its own
+	CounterDeltaGauge
+
+	// CounterRate reports the per-second rate of change since the previous
+	// flush as a gauge, independent of how Datadog interprets counts
+	CounterRate
+)
+
+func (m CounterMode) String() string {
+	switch m {
+	case CounterDelta:
+		return "delta"
+	case CounterDeltaGauge:
+		return "delta-gauge"
+	case CounterRate:
+		return "rate"
+	}
+
+	return fmt.Sprintf("CounterMode(%d)", int(m))
+}
+
+// bufferAgeMetric is the name of the gauge sent with WithBufferAgeMetric
+const bufferAgeMetric = "datadog_reporter.buffer_age_seconds"
+
+// buildInfoMetric is the name of the gauge sent with WithBuildInfo
+const buildInfoMetric = "build_info"
+
+// CloseTimeout bounds how long Close waits for the final flush of a reporter
+// with WithBlockingFlush.
+var CloseTimeout = 5 * time.Second
+
+// kubernetesTags are the tags added by WithKubernetesTags, and the environment
+// variables their values are read from
+var kubernetesTags = []struct {
+	env, tag string
+}{
+	{"POD_NAME", "pod_name"},
+	{"POD_NAMESPACE", "kube_namespace"},
+	{"NODE_NAME", "node"},
+}
+
+// entityIDTag is the tag the statsd client uses for origin detection
+const entityIDTag = "dd.internal.entity_id"
+
+// TelemetryClient is implemented by statsd clients counting the metrics, events
+// and service checks they are sent, such as *statsd.Client. Each call returns
+// and resets the counts.
+type TelemetryClient interface {
+	FlushTelemetryMetrics() statsd.ClientMetrics
+}
+
+// droppedMetric is the name of the count of suppressed values
+const droppedMetric = "datadog_reporter.dropped"
+
+// TimerMode determines how timers are reported to Datadog
+type TimerMode int
+
+const (
+	// TimerSummary reports timers as gauges of their count, statistics and
+	// percentiles
+	TimerSummary TimerMode = iota
+
+	// TimerDistribution reports timers as a distribution. go-metrics timers
+	// don't expose their sampled values, so whenever a timer is updated its
+	// values at each percentile are sent as a representative sample.
+	TimerDistribution
+
+	// TimerSummaryAndDistribution reports timers both as with TimerSummary
+	// and as with TimerDistribution, the distribution being named with a
+	// .dist suffix. This doubles the cost of timers, and eases migrating
+	// dashboards from one to the other.
+	TimerSummaryAndDistribution
+)
+
+// ErrorMode determines how a flush continues after failing to send a metric
+type ErrorMode int
+
+const (
+	// BestEffort keeps sending the remaining metrics of the flush
+	BestEffort ErrorMode = iota
+
+	// FailFast sends nothing more in the flush, to avoid flooding an agent
+	// that is down. With WithMaxInflight, sends already started still
+	// complete.
+	FailFast
+)
+
+// ConflictPolicy determines how metrics of the same name found in several
+// registries are reported, when they are not merged
+type ConflictPolicy int
+
+const (
+	// ConflictOverwrite reports them all under the same name, so that Datadog
+	// keeps whichever value it receives last. Each keeps its own state between
+	// flushes, such as the previous count of counters.
+	ConflictOverwrite ConflictPolicy = iota
+
+	// ConflictSuffix reports the metric of the first registry under its name
+	// and those of later registries with a _1, _2... suffix
+	ConflictSuffix
+
+	// ConflictTag reports them all under the same name, tagged with the
+	// index of their registry, such as registry:1
+	ConflictTag
+)
+
 // FlushLength determines the number of metrics to be buffered before submitting
 // to Datadog.
 var FlushLength = 32
@@ -22,10 +156,48 @@ func WithAddress(v string) configFn {
 	}
 }
 
-// WithPrefix sets a Datadog namespace for all metrics
+// WithConn sends metrics through conn, such as a wrapped or instrumented
+// connection, rather than one dialed to the agent address. The reporter takes
+// ownership of conn and closes it on Close. WithConnectionPool is ignored with
+// a connection.
+func WithConn(conn net.Conn) configFn {
+	return func(r *Reporter) {
+		r.conn = conn
+	}
+}
+
+// WithAddressResolver sets a function returning the UDP address to report
+// datadog metrics, consulted when New connects to the agent. When it fails,
+// the address set with WithAddress is kept, and the failure is logged.
+func WithAddressResolver(fn func() (string, error)) configFn {
+	return func(r *Reporter) {
+		r.resolve = fn
+	}
+}
+
+// WithLogger sets the logger used to report problems. The standard logger is
+// used by default.
+func WithLogger(v Logger) configFn {
+	return func(r *Reporter) {
+		r.logger = v
+	}
+}
+
+// WithWriteTimeout fails UDP writes to the agent that block for longer than d,
+// such as when the socket buffer is full, so that they don't stall reporting.
+// Metrics of failed writes are dropped, and the error is returned by Flush.
+// Writes over unix sockets use the timeout of the statsd client instead.
+func WithWriteTimeout(d time.Duration) configFn {
+	return func(r *Reporter) {
+		r.writeTimeout = d
+	}
+}
+
+// WithPrefix sets a Datadog namespace for all metrics. An empty prefix leaves
+// metric names unqualified.
 func WithPrefix(v string) configFn {
 	return func(r *Reporter) {
-		if !strings.HasSuffix(v, ".") {
+		if v != "" && !strings.HasSuffix(v, ".") {
 			v += "."
 		}
 
@@ -33,6 +205,73 @@ func WithPrefix(v string) configFn {
 	}
 }
 
+// WithMaxTagValueLength truncates the values of tags longer than n bytes
+// before sending them, so that they aren't truncated or rejected by Datadog,
+// splitting their series. Tags without a value are truncated as a whole, and
+// tags are never truncated within a multi-byte UTF-8 character.
+func WithMaxTagValueLength(n int) configFn {
+	return func(r *Reporter) {
+		r.maxTagValue = n
+	}
+}
+
+// WithTimerOps also sends the number of calls of each timer since the previous
+// flush as a count, named with the ".ops" suffix, so that the throughput can be
+// aggregated across hosts.
+func WithTimerOps(v bool) configFn {
+	return func(r *Reporter) {
+		r.timerOps = v
+	}
+}
+
+// WithTimerOpsSuffix sets the suffix of the counts sent by WithTimerOps
+func WithTimerOpsSuffix(v string) configFn {
+	return func(r *Reporter) {
+		r.timerOpsSuffix = v
+	}
+}
+
+// WithSecondaryPrefix also sends every metric under a second namespace, such
+// as the old one while renaming the prefix, doubling the traffic. Both
+// prefixes are then added to the metric names rather than set as the
+// namespace of the client. Deltas are computed once and sent under both.
+func WithSecondaryPrefix(v string) configFn {
+	return func(r *Reporter) {
+		if v != "" && !strings.HasSuffix(v, ".") {
+			v += "."
+		}
+
+		r.secondaryPrefix = v
+	}
+}
+
+// WithRegistries sets several registries from which metrics should be
+// reported, in place of the registry set with WithRegistry
+func WithRegistries(v ...metrics.Registry) configFn {
+	return func(r *Reporter) {
+		r.registries = v
+	}
+}
+
+// WithMergedRegistries combines the metrics of the same name found in several
+// registries before reporting them once, summing counters and meters and
+// merging the samples of histograms. Of other metrics of the same name, such
+// as gauges and timers, only the first is reported.
+func WithMergedRegistries(v bool) configFn {
+	return func(r *Reporter) {
+		r.mergeRegistries = v
+	}
+}
+
+// WithReporterName names the reporter, to tell apart several reporters of a
+// process. The name is included in logs and String, and tags metrics about the
+// reporter itself as reporter:<name>.
+func WithReporterName(v string) configFn {
+	return func(r *Reporter) {
+		r.name = v
+	}
+}
+
 // WithRegistry sets the registry from which metrics should be reported
 func WithRegistry(v metrics.Registry) configFn {
 	return func(r *Reporter) {
@@ -40,142 +279,2006 @@ func WithRegistry(v metrics.Registry) configFn {
 	}
 }
 
-// WithPercentiles sets the percentiles to use for statistical metrics.
-// The default percentiles are 75%, 95%, 99% and 99.9%
-//
-// Set to nil to disable percentiles.
-func WithPercentiles(v []float64) configFn {
+// WithClient sets the statsd client used to send metrics to Datadog. It takes
+// precedence over the options configuring the client created by the reporter,
+// such as WithAddress, WithConn, WithConnectionPool and WithWriteTimeout, and
+// over FlushLength. The namespace of a *statsd.Client is set to the prefix,
+// unless WithClientNamespaceUnmanaged is set, and Close closes the client,
+// unless WithCloseClient(false) is set.
+func WithClient(v statsd.ClientInterface) configFn {
 	return func(r *Reporter) {
-		r.percentiles = v
+		r.cn = v
 	}
 }
 
-// WithClient sets the statsd client used to send metrics to Datadog
-func WithClient(v *statsd.Client) configFn {
+// WithClientNamespaceUnmanaged leaves the namespace of a *statsd.Client set
+// with WithClient as it is, rather than setting it to the prefix. The file
+// sink then writes names with the namespace of the client, as they are sent.
+func WithClientNamespaceUnmanaged(v bool) configFn {
 	return func(r *Reporter) {
-		r.cn = v
+		r.unmanagedNamespace = v
 	}
 }
 
-// Reporter represents a Datadog metrics reporter
-type Reporter struct {
-	addr        string
-	prefix      string
-	registry    metrics.Registry
-	cn          *statsd.Client
-	tags        []string
-	percentiles []float64
-	p           []string
-	ss          map[string]int64
+// WithCloseClient sets whether Close closes a client set with WithClient,
+// which the caller may want to keep using. Enabled by default.
+func WithCloseClient(v bool) configFn {
+	return func(r *Reporter) {
+		r.ownsClient = v
+	}
 }
 
-// New creates a new Datadog metrics reporter
-func New(options ...configFn) (r *Reporter, err error) {
-	r = &Reporter{
-		addr:        "127.0.0.1:8125",
-		registry:    metrics.DefaultRegistry,
-		percentiles: []float64{0.50, 0.75, 0.95, 0.99, 0.999},
-		ss:          make(map[string]int64),
+// WithSampleSize reports the number of values held by the sample of each
+// histogram as name.sample_size. Percentiles are computed from these values,
+// which may be far fewer than the count of a down-sampling sample.
+func WithSampleSize(v bool) configFn {
+	return func(r *Reporter) {
+		r.sampleSize = v
 	}
+}
 
-	for _, opt := range options {
-		opt(r)
+// WithTypeTag tags every metric with dd_metric_origin set to the go-metrics
+// type it was reported from. Disabled by default as it adds cardinality.
+func WithTypeTag(v bool) configFn {
+	return func(r *Reporter) {
+		r.typeTag = v
+	}
+}
+
+// WithFlushCounter counts every flush as an increment of the named counter,
+// showing in Datadog whether and how often the reporter flushes
+func WithFlushCounter(name string) configFn {
+	return func(r *Reporter) {
+		r.flushCounter = name
 	}
+}
 
-	if len(r.percentiles) > 0 {
-		r.p = make([]string, len(r.percentiles))
-		for i, p := range r.percentiles {
-			r.p[i] = fmt.Sprintf(".pct-%.2f", p*100.0)
-		}
+// WithHistogramSumTotal reports, for the histograms for which fn returns true,
+// the increase of the sum of their values since the previous flush as a count
+// named name.sum_total, so that totals such as bytes can be summed across
+// hosts. The sum is that of the values held by the sample of the histogram, so
+// the count is exact only while the sample holds every value. Nothing is
+// reported for a flush in which the sum decreases, as when the histogram is
+// cleared or its sample drops values.
+func WithHistogramSumTotal(fn func(name string) bool) configFn {
+	return func(r *Reporter) {
+		r.sumTotal = fn
 	}
+}
 
-	if r.cn == nil {
-		if FlushLength > 1 {
-			r.cn, err = statsd.NewBuffered(r.addr, FlushLength)
+// WithDurationHistograms marks the histograms for which fn returns true as
+// holding durations in nanoseconds. Like timers, their values are reported in
+// milliseconds, rounded to the timer precision.
+func WithDurationHistograms(fn func(name string) bool) configFn {
+	return func(r *Reporter) {
+		r.durationHistograms = fn
+	}
+}
+
+// WithEmissionBuffer coalesces the gauges of a flush that are sent to the same
+// series, that is with the same name and tags, into a single value. Values
+// are combined with reduce, such as math.Max, or when nil the last value is
+// kept.
+func WithEmissionBuffer(reduce func(prev, v float64) float64) configFn {
+	return func(r *Reporter) {
+		r.coalesce = true
+		r.reduce = reduce
+	}
+}
+
+// WithRenderer sets how metrics are rendered for the file sink. Metrics are
+// rendered in the DogStatsD wire format by default.
+func WithRenderer(fn Renderer) configFn {
+	return func(r *Reporter) {
+		r.render = fn
+	}
+}
+
+// WithNameRegex reports only the metrics whose names match re when include is
+// true, and only those whose names don't match when false
+func WithNameRegex(re *regexp.Regexp, include bool) configFn {
+	return func(r *Reporter) {
+		r.nameRegex = re
+		r.nameInclude = include
+	}
+}
+
+// WithDroppedCounter counts the values suppressed by each flush as
+// datadog_reporter.dropped, tagged with the reason: filter for metrics excluded
+// by WithNameRegex, non_finite for NaN and infinite values, dedup for gauges
+// skipped by WithGaugeKeepAlive, zero for counters skipped by
+// WithSkipZeroCounters, pre_send for metrics dropped by WithPreSendFilter,
+// queue_full for metrics dropped by WithQueueBuffer, and panic for metrics
+// that panicked.
+func WithDroppedCounter(v bool) configFn {
+	return func(r *Reporter) {
+		r.droppedCounter = v
+	}
+}
+
+// WithPreSendFilter passes every metric to fn right before it is sent, once
+// renamed, tagged and deduplicated. The metric is dropped when fn returns
+// false, and sent as changed by fn otherwise, to the client and the file sink.
+// Counts are rounded to an integer after fn. Events sent about metrics, such
+// as with WithHealthcheckEvents, are passed as emissions of EventType.
+func WithPreSendFilter(fn func(e *Emission) bool) configFn {
+	return func(r *Reporter) {
+		r.preSend = fn
+	}
+}
+
+// WithFileSink writes the DogStatsD line of every metric to w, in addition to
+// sending it to the client. Useful to capture metrics where no agent is
+// reachable.
+func WithFileSink(w io.Writer) configFn {
+	return func(r *Reporter) {
+		r.sink = w
+	}
+}
+
+// WithMaxInflight sends metrics to the client concurrently, with at most n
+// sends in flight at once. A flush still waits for all of its sends to
+// complete. Metrics are sent in order from a single goroutine by default.
+func WithMaxInflight(n int) configFn {
+	return func(r *Reporter) {
+		if n > 0 {
+			r.inflight = make(chan struct{}, n)
 		} else {
-			r.cn, err = statsd.New(r.addr)
+			r.inflight = nil
 		}
 	}
+}
 
-	if err != nil {
-		return nil, err
+// WithBlockingFlush flushes a final snapshot of metrics when the reporter is
+// closed, waiting for it to be written
+func WithBlockingFlush(v bool) configFn {
+	return func(r *Reporter) {
+		r.blockingFlush = v
 	}
-	r.cn.Namespace = r.prefix
+}
 
-	return
+// WithCounterMode sets how counters are reported. The default is CounterDelta.
+func WithCounterMode(v CounterMode) configFn {
+	return func(r *Reporter) {
+		r.counterMode = v
+	}
 }
 
-// FlushWithInterval repeatedly submits a snapshot of metrics to Datadog at an
-// interval specified by i
-func (r *Reporter) FlushWithInterval(i time.Duration) {
-	for range time.Tick(i) {
-		r.submit()
+// WithTimerMode sets how timers are reported. The default is TimerSummary.
+func WithTimerMode(v TimerMode) configFn {
+	return func(r *Reporter) {
+		r.timerMode = v
 	}
 }
 
-// Flush submits a snapshot of metrics to Datadog
-func (r *Reporter) Flush() error {
-	return r.submit()
-}
-
-func (r *Reporter) submit() error {
-	r.registry.Each(func(name string, i interface{}) {
-		switch metric := i.(type) {
-		case metrics.Counter:
-			v := metric.Count()
-			l := r.ss[name]
-			r.cn.Count(name, v-l, r.tags, 1)
-			r.ss[name] = v
-
-		case metrics.Gauge:
-			r.cn.Gauge(name, float64(metric.Value()), r.tags, 1)
-
-		case metrics.GaugeFloat64:
-			r.cn.Gauge(name, metric.Value(), r.tags, 1)
-
-		case metrics.Histogram:
-			ms := metric.Snapshot()
-
-			r.cn.Gauge(name+".count", float64(ms.Count()), r.tags, 1)
-			r.cn.Gauge(name+".max", float64(ms.Max()), r.tags, 1)
-			r.cn.Gauge(name+".min", float64(ms.Min()), r.tags, 1)
-			r.cn.Gauge(name+".mean", ms.Mean(), r.tags, 1)
-			r.cn.Gauge(name+".stddev", ms.StdDev(), r.tags, 1)
-			r.cn.Gauge(name+".var", ms.Variance(), r.tags, 1)
-
-			if len(r.percentiles) > 0 {
-				values := ms.Percentiles(r.percentiles)
-				for i, p := range r.p {
-					r.cn.Gauge(name+p, values[i], r.tags, 1)
-				}
-			}
+// WithTimerPrecision rounds timer values to the given number of decimal
+// places of milliseconds. Set to a negative number to disable rounding, which
+// is the default.
+func WithTimerPrecision(digits int) configFn {
+	return func(r *Reporter) {
+		r.timerPrecision = digits
+	}
+}
 
-		case metrics.Meter:
-			ms := metric.Snapshot()
+// FlushStats describes a single flush to Datadog
+type FlushStats struct {
+	// Metrics is the number of metrics reported, by go-metrics type
+	Metrics map[string]int
 
-			r.cn.Gauge(name+".count", float64(ms.Count()), r.tags, 1)
-			r.cn.Gauge(name+".rate1", ms.Rate1(), r.tags, 1)
-			r.cn.Gauge(name+".rate5", ms.Rate5(), r.tags, 1)
-			r.cn.Gauge(name+".rate15", ms.Rate15(), r.tags, 1)
-			r.cn.Gauge(name+".mean", ms.RateMean(), r.tags, 1)
+	// Emissions is the number of values sent to the client
+	Emissions int
 
-		case metrics.Timer:
-			ms := metric.Snapshot()
+	// Errors is the number of sends that failed
+	Errors int
 
-			r.cn.Gauge(name+".count", float64(ms.Count()), r.tags, 1)
-			r.cn.Gauge(name+".max", time.Duration(ms.Max()).Seconds()*1000, r.tags, 1)
-			r.cn.Gauge(name+".min", time.Duration(ms.Min()).Seconds()*1000, r.tags, 1)
-			r.cn.Gauge(name+".mean", time.Duration(ms.Mean()).Seconds()*1000, r.tags, 1)
-			r.cn.Gauge(name+".stddev", time.Duration(ms.StdDev()).Seconds()*1000, r.tags, 1)
+	// Duration is how long the flush took
+	Duration time.Duration
+}
 
-			if len(r.percentiles) > 0 {
-				values := ms.Percentiles(r.percentiles)
-				for i, p := range r.p {
-					r.cn.Gauge(name+p, time.Duration(values[i]).Seconds()*1000, r.tags, 1)
-				}
-			}
+// WithOnFlush sets a function called with the stats of every flush
+func WithOnFlush(fn func(FlushStats)) configFn {
+	return func(r *Reporter) {
+		r.onFlush = fn
+	}
+}
+
+// WithSkipZeroCounters skips counters that haven't changed since the previous
+// flush, rather than reporting an increase of zero
+func WithSkipZeroCounters(v bool) configFn {
+	return func(r *Reporter) {
+		r.skipZeroCounters = v
+	}
+}
+
+// WithCardinalityMetric reports, for each metric, the number of distinct tag
+// sets with which it was reported in the flush as name.series_count, such as
+// one per registry with ConflictTag, to monitor the growth of cardinality
+func WithCardinalityMetric(v bool) configFn {
+	return func(r *Reporter) {
+		r.cardinality = v
+	}
+}
+
+// WithObserved reports, for the metrics for which fn returns true, a gauge of 1
+// as name.observed whenever they are found in the registry, whatever their
+// value. This lets dashboards tell a metric without events, such as a counter
+// skipped by WithSkipZeroCounters, from one that isn't reported at all. Each
+// metric observed adds a series.
+func WithObserved(fn func(name string) bool) configFn {
+	return func(r *Reporter) {
+		r.observed = fn
+	}
+}
+
+// WithConnectionPool sends metrics to the agent over n sockets, each metric
+// sent through the next socket in turn, to increase throughput at very high
+// volumes. Each socket is a separate statsd client with its own buffers.
+func WithConnectionPool(n int) configFn {
+	return func(r *Reporter) {
+		r.poolSize = n
+	}
+}
+
+// WithStalenessMetric reports, for the metrics for which fn returns true, the
+// seconds since their value last changed as name.staleness_seconds, to alert
+// on metrics that stop updating. Gauges change with their value, and other
+// metrics with their count.
+func WithStalenessMetric(fn func(name string) bool) configFn {
+	return func(r *Reporter) {
+		r.staleness = fn
+	}
+}
+
+// WithErrorMode sets how a flush continues after failing to send a metric.
+// Defaults to BestEffort.
+func WithErrorMode(m ErrorMode) configFn {
+	return func(r *Reporter) {
+		r.errorMode = m
+	}
+}
+
+// WithBuildInfo sends a build_info gauge of 1 every flush, tagged with info
+// such as the version and commit, for dashboards to correlate with deploys
+func WithBuildInfo(info map[string]string) configFn {
+	return func(r *Reporter) {
+		r.buildInfo = make([]string, 0, len(info))
+		for k, v := range info {
+			r.buildInfo = append(r.buildInfo, k+":"+v)
 		}
-	})
+		sort.Strings(r.buildInfo)
+	}
+}
 
-	return nil
+// WithConflictPolicy sets how metrics of the same name found in several
+// registries are reported, when they are not merged with
+// WithMergedRegistries. Defaults to ConflictOverwrite.
+func WithConflictPolicy(p ConflictPolicy) configFn {
+	return func(r *Reporter) {
+		r.conflictPolicy = p
+	}
+}
+
+// WithHistogramFlushEvery reports histograms and timers only every nth flush,
+// starting with the first, for those that are costly to compute and change
+// slowly. Other metrics are reported every flush.
+func WithHistogramFlushEvery(n int) configFn {
+	return func(r *Reporter) {
+		r.histogramEvery = n
+	}
+}
+
+// WithGoroutineGauge sends the number of goroutines as a gauge of the given
+// name every flush, a cheap signal of goroutine leaks that doesn't require
+// capturing the runtime memory stats. It is tagged like the other metrics
+// about the reporter.
+func WithGoroutineGauge(name string) configFn {
+	return func(r *Reporter) {
+		r.goroutineGauge = name
+	}
+}
+
+// WithContainerTag tags metrics with the ID of the container running the
+// process, read from its cgroup, as container_id:<id>. This attributes metrics
+// to containers when the agent can't detect their origin. Outside of
+// containers, nothing is added.
+func WithContainerTag(v bool) configFn {
+	return func(r *Reporter) {
+		r.containerTag = v
+	}
+}
+
+// WithShardTag tags every metric with key:<shard>, its shard out of the given
+// number of shards, to spread high cardinality metrics evenly. The shard is
+// computed from the metric name with hashFn, or FNV-1a when nil. The option is
+// ignored, and logged, unless shards is positive.
+func WithShardTag(key string, shards int, hashFn func(name string) int) configFn {
+	return func(r *Reporter) {
+		r.shardKey = key
+		r.shards = shards
+		r.shardHash = hashFn
+	}
+}
+
+// WithPanicRecovery sets whether a panic while reporting a metric, such as in
+// a metric of a custom type, is logged and the metric skipped, rather than
+// crashing the process. A panic elsewhere in a flush ends the flush with an
+// error. Enabled by default.
+func WithPanicRecovery(v bool) configFn {
+	return func(r *Reporter) {
+		r.panicRecovery = v
+	}
+}
+
+// WithTimestampSkew corrects the timestamps of events sent with Event by d,
+// for hosts whose clock is known to be off. A host clock that is 2s behind
+// is corrected with a skew of 2s. Metrics are timestamped by the agent on
+// receipt, so aren't affected.
+func WithTimestampSkew(d time.Duration) configFn {
+	return func(r *Reporter) {
+		r.skew = d
+	}
+}
+
+// WithBufferAgeMetric sends datadog_reporter.buffer_age_seconds every flush,
+// the seconds since the client's buffer was last drained without error by a
+// flush, estimating how long metrics wait to be sent. A growing value shows
+// the agent isn't keeping up.
+func WithBufferAgeMetric(v bool) configFn {
+	return func(r *Reporter) {
+		r.bufferAge = v
+	}
+}
+
+// WithMinFlushInterval limits flushes requested with TriggerFlush to one per
+// interval d
+func WithMinFlushInterval(d time.Duration) configFn {
+	return func(r *Reporter) {
+		r.minFlushInterval = d
+	}
+}
+
+// WithMetricKinds sets the DogStatsD type with which the named counters and
+// gauges are reported, in place of the type following from their go-metrics
+// type and the other options. The value of a counter is its increase since the
+// previous flush, and of a gauge its value. Gauges can only be reported as
+// gauges or counts, as a single value per flush is no sample of a
+// distribution. Invalid kinds are logged and ignored.
+func WithMetricKinds(v map[string]DDType) configFn {
+	return func(r *Reporter) {
+		r.kinds = v
+	}
+}
+
+// WithKubernetesTags tags metrics with the pod, namespace and node names found
+// in the POD_NAME, POD_NAMESPACE and NODE_NAME environment variables, as
+// commonly set from the Kubernetes downward API, as pod_name:, kube_namespace:
+// and node: tags. Variables that aren't set are skipped.
+func WithKubernetesTags() configFn {
+	return func(r *Reporter) {
+		r.kubernetesTags = true
+	}
+}
+
+// WithCounterDualEmit reports counters both as usual and as a gauge of their
+// cumulative count, name.total, to ease migrating dashboards from one to the
+// other
+func WithCounterDualEmit(v bool) configFn {
+	return func(r *Reporter) {
+		r.counterTotal = v
+	}
+}
+
+// WithRandSource sets the source of the randomness used by the reporter, such
+// as for flush jitter, to make it reproducible in tests. Defaults to a source
+// seeded with the current time.
+func WithRandSource(src rand.Source) configFn {
+	return func(r *Reporter) {
+		r.rand = rand.New(src)
+	}
+}
+
+// WithFlushJitter delays each flush of FlushWithInterval by a random duration
+// up to max, so that many processes started together don't flush at once
+func WithFlushJitter(max time.Duration) configFn {
+	return func(r *Reporter) {
+		r.maxJitter = max
+	}
+}
+
+// WithStartTimeMetric sends the time the reporter was created, in Unix
+// seconds, as a gauge of the given name every flush, from which Datadog can
+// compute its uptime
+func WithStartTimeMetric(name string) configFn {
+	return func(r *Reporter) {
+		r.startTimeMetric = name
+	}
+}
+
+// WithClientTelemetry reports the telemetry of the statsd client every flush,
+// when the client implements TelemetryClient, as counts of the metrics, events
+// and service checks it was sent, and of the metrics it dropped: the
+// datadog_reporter.client.metrics, .events, .service_checks and
+// .dropped_on_receive counts. The client created by the reporter then doesn't
+// send its own telemetry, which shares the same counts.
+func WithClientTelemetry(v bool) configFn {
+	return func(r *Reporter) {
+		r.clientTelemetry = v
+	}
+}
+
+// WithActiveWindow skips flushes when fn returns false, such as while a batch
+// job is idle, so that idle periods don't show as flat lines. Nothing is sent
+// by a skipped flush, and the changes to counters and meters in the meantime
+// are reported by the next flush.
+func WithActiveWindow(fn func() bool) configFn {
+	return func(r *Reporter) {
+		r.active = fn
+	}
+}
+
+// WithMetricDescriptions tags the named metrics with desc:<description>, for
+// engineers browsing Datadog to understand them. Each description adds a tag
+// value, so they should be short and stable, such as "http_requests_served".
+func WithMetricDescriptions(v map[string]string) configFn {
+	return func(r *Reporter) {
+		r.descriptions = v
+	}
+}
+
+// MetricOrigin is a go-metrics type of metrics
+type MetricOrigin string
+
+const (
+	// OriginCounter is the type of counters
+	OriginCounter MetricOrigin = "counter"
+
+	// OriginGauge is the type of gauges, of integers and floats
+	OriginGauge MetricOrigin = "gauge"
+
+	// OriginHistogram is the type of histograms
+	OriginHistogram MetricOrigin = "histogram"
+
+	// OriginMeter is the type of meters
+	OriginMeter MetricOrigin = "meter"
+
+	// OriginTimer is the type of timers
+	OriginTimer MetricOrigin = "timer"
+)
+
+// origins are the go-metrics types of metrics reported
+var origins = []MetricOrigin{OriginCounter, OriginGauge, OriginHistogram, OriginMeter, OriginTimer}
+
+// WithTypeIntervals sets the intervals at which FlushWithInterval flushes
+// metrics of the given go-metrics types. Types without an interval are flushed
+// at the interval given to FlushWithInterval. Metrics are flushed at the
+// greatest common divisor of the intervals, each flush sending the types that
+// are due, so intervals should be multiples of a common duration. Unknown
+// types and intervals that aren't positive are ignored, and logged.
+func WithTypeIntervals(v map[MetricOrigin]time.Duration) configFn {
+	return func(r *Reporter) {
+		r.typeIntervalsIn = v
+	}
+}
+
+// valid returns whether o is a known go-metrics type
+func (o MetricOrigin) valid() bool {
+	for _, origin := range origins {
+		if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// validTypeIntervals returns the intervals of WithTypeIntervals of known
+// types, logging the others and those that aren't positive
+func (r *Reporter) validTypeIntervals() map[string]time.Duration {
+	if len(r.typeIntervalsIn) == 0 {
+		return nil
+	}
+
+	res := make(map[string]time.Duration)
+	for origin, d := range r.typeIntervalsIn {
+		switch {
+		case !origin.valid():
+			r.logf("ignoring flush interval of unknown metric type %q", origin)
+		case d <= 0:
+			r.logf("ignoring flush interval %s of %s, as it isn't positive", d, origin)
+		default:
+			res[string(origin)] = d
+		}
+	}
+	return res
+}
+
+// WithAggregator reports the metrics returned by fn from the registries of the
+// reporter, in place of the metrics of the registries, for fn to combine or
+// rename them. The values must be go-metrics counters, gauges, histograms,
+// meters or timers, or their snapshots, such as metrics.CounterSnapshot; other
+// values are ignored. WithMergedRegistries and WithConflictPolicy don't apply.
+func WithAggregator(fn func([]metrics.Registry) map[string]interface{}) configFn {
+	return func(r *Reporter) {
+		r.aggregator = fn
+	}
+}
+
+// WithIntervalMetric sends the interval given to FlushWithInterval, in
+// seconds, as a gauge of the given name every flush, for dashboards to divide
+// counts by. Nothing is sent before FlushWithInterval is called.
+func WithIntervalMetric(name string) configFn {
+	return func(r *Reporter) {
+		r.intervalMetric = name
+	}
+}
+
+// WithDefaultSample sets the function creating the samples of histograms
+// created by the reporter itself, such as those of WithPerFlushPercentiles,
+// to control their size and decay. By default, these are a
+// metrics.ExpDecaySample of the n values of WithPerFlushPercentiles, favoring
+// the last 5 minutes like the samples of go-metrics timers.
+func WithDefaultSample(fn func() metrics.Sample) configFn {
+	return func(r *Reporter) {
+		r.defaultSample = fn
+	}
+}
+
+// WithOriginDetection sets whether the client created by the reporter tags
+// metrics with the entity ID found in DD_ENTITY_ID, allowing the agent to
+// enrich them with the metadata of the sending pod or container. Enabled by
+// default; it has no effect on a client set with WithClient.
+func WithOriginDetection(v bool) configFn {
+	return func(r *Reporter) {
+		r.originDetection = v
+	}
+}
+
+// Reporter represents a Datadog metrics reporter
+type Reporter struct {
+	addr                string
+	prefix              string
+	registry            metrics.Registry
+	cn                  statsd.ClientInterface
+	tags                []string
+	percentiles         []float64
+	typeTag             bool
+	instantRate         bool
+	counterMode         CounterMode
+	timerPrecision      int
+	gaugePrecision      int
+	wholeGauges         bool
+	p                   []string
+	ss                  map[string]int64
+	now                 func() time.Time
+	last                time.Time
+	sink                io.Writer
+	buf                 []byte
+	err                 error
+	inflight            chan struct{}
+	wg                  sync.WaitGroup
+	mu                  sync.Mutex
+	onFlush             func(FlushStats)
+	stats               FlushStats
+	originDetection     bool
+	percentileNames     map[float64]string
+	resolve             func() (string, error)
+	dialed              bool
+	logger              Logger
+	sampleSize          bool
+	writeTimeout        time.Duration
+	ws                  []*deadlineWriter
+	flushCounter        string
+	metricPercentiles   func(name string) []float64
+	zeroOnRemoval       bool
+	gauges              map[gaugeSeries]bool
+	meterDelta          bool
+	coalesce            bool
+	reduce              func(prev, v float64) float64
+	pending             []pendingGauge
+	series              map[string]int
+	durationHistograms  func(name string) bool
+	name                string
+	keepAlive           time.Duration
+	sent                map[string]sentGauge
+	droppedCounter      bool
+	dropped             map[string]int64
+	render              Renderer
+	timerMode           TimerMode
+	bands               []PercentileBand
+	blockingFlush       bool
+	stop                chan struct{}
+	closing             sync.Once
+	loop                sync.WaitGroup
+	loopMu              sync.Mutex
+	flushMu             sync.Mutex
+	triggerMu           sync.Mutex
+	trigger             *time.Timer
+	triggered           time.Time
+	minFlushInterval    time.Duration
+	kinds               map[string]DDType
+	invalidKinds        map[string]bool
+	kubernetesTags      bool
+	counterTotal        bool
+	rand                *rand.Rand
+	maxJitter           time.Duration
+	started             time.Time
+	startTimeMetric     string
+	minSamples          int
+	clientTelemetry     bool
+	active              func() bool
+	descriptions        map[string]string
+	typeIntervals       map[string]time.Duration
+	typeIntervalsIn     map[MetricOrigin]time.Duration
+	lastFlushed         map[string]time.Time
+	due                 map[string]bool
+	aggregator          func([]metrics.Registry) map[string]interface{}
+	interval            time.Duration
+	intervalMetric      string
+	fidelity            DistributionFidelity
+	defaultSample       func() metrics.Sample
+	nameRegex           *regexp.Regexp
+	nameInclude         bool
+	gaugeDelta          func(name string) bool
+	lastGauges          map[string]float64
+	unmanagedNamespace  bool
+	secondaryPrefix     string
+	timerOps            bool
+	timerOpsSuffix      string
+	maxTagValue         int
+	truncated           map[string]struct{}
+	ownsClient          bool
+	registries          []metrics.Registry
+	mergeRegistries     bool
+	monotonic           func(name string) bool
+	monotonicCount      func(name string) bool
+	monotonicMax        float64
+	skipZeroCounters    bool
+	observed            func(name string) bool
+	durationGauges      func(name string) bool
+	durationUnit        time.Duration
+	preSend             func(e *Emission) bool
+	sumTotal            func(name string) bool
+	features            Features
+	cardinality         bool
+	tagSets             map[string]map[string]struct{}
+	meterPacking        bool
+	meters              *statsd.Client
+	batch               statsd.ClientInterface
+	healthcheckEvents   bool
+	failing             map[string]bool
+	queue               chan func() error
+	queueDrop           bool
+	queueStop           sync.Once
+	queueClosed         bool
+	gs                  map[string]float64
+	iqr                 bool
+	mad                 bool
+	poolSize            int
+	staleness           func(name string) bool
+	changed             map[string]lastChange
+	errorMode           ErrorMode
+	buildInfo           []string
+	conn                net.Conn
+	conflictPolicy      ConflictPolicy
+	source              string
+	sourceRegistry      int
+	histogramEvery      int
+	flushes             int
+	goroutineGauge      string
+	numGoroutine        func() int
+	containerTag        bool
+	perFlush            func(name string) bool
+	perFlushWindow      int
+	deltas              map[string]metrics.Histogram
+	shardKey            string
+	shards              int
+	shardHash           func(name string) int
+	panicRecovery       bool
+	skew                time.Duration
+	bufferAge           bool
+	drained             time.Time
+	histogramDist       func(name string) bool
+	histogramDistValues int
+}
+
+// New creates a new Datadog metrics reporter
+func New(options ...configFn) (r *Reporter, err error) {
+	r = &Reporter{
+		addr:            "127.0.0.1:8125",
+		registry:        metrics.DefaultRegistry,
+		percentiles:     []float64{0.50, 0.75, 0.95, 0.99, 0.999},
+		ss:              make(map[string]int64),
+		timerPrecision:  -1,
+		gaugePrecision:  -1,
+		originDetection: true,
+		features:        AllFeatures,
+		panicRecovery:   true,
+		ownsClient:      true,
+		timerOpsSuffix:  ".ops",
+		rand:            rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:             time.Now,
+		numGoroutine:    runtime.NumGoroutine,
+		logger:          log.Default(),
+		stop:            make(chan struct{}),
+	}
+
+	for _, opt := range options {
+		opt(r)
+	}
+
+	if r.perFlush != nil && r.perFlushWindow <= 0 {
+		r.logf("ignoring per-flush percentiles over %d flushes", r.perFlushWindow)
+		r.perFlush = nil
+	}
+
+	r.typeIntervals = r.validTypeIntervals()
+
+	if r.shardKey != "" && r.shards <= 0 {
+		r.logf("ignoring shard tag %s over %d shards", r.shardKey, r.shards)
+		r.shardKey = ""
+	}
+
+	r.last = r.now()
+	r.drained = r.last
+	r.started = r.last
+
+	if len(r.percentiles) > 0 {
+		r.p = make([]string, len(r.percentiles))
+		for i, p := range r.percentiles {
+			r.p[i] = r.percentileSuffix(p)
+		}
+	}
+
+	if r.containerTag {
+		if id := containerID(); id != "" {
+			r.tags = append(r.tags, "container_id:"+id)
+		}
+	}
+
+	if r.kubernetesTags {
+		for _, t := range kubernetesTags {
+			if v := os.Getenv(t.env); v != "" {
+				r.tags = append(r.tags, t.tag+":"+v)
+			}
+		}
+	}
+
+	if r.cn == nil {
+		if r.cn, err = r.connect(); err != nil {
+			return nil, err
+		}
+		r.dialed = true
+	} else if cn, ok := r.cn.(*statsd.Client); ok && !r.unmanagedNamespace {
+		cn.Namespace = r.namespace()
+	}
+
+	if r.queue != nil {
+		go r.sendQueued(r.queue)
+	}
+
+	return
+}
+
+// connect creates the client for the agent, resolving its address first when
+// an address resolver is set. The client is a pool of clients with
+// WithConnectionPool.
+func (r *Reporter) connect() (statsd.ClientInterface, error) {
+	if r.resolve != nil {
+		if addr, err := r.resolve(); err != nil {
+			r.logf("unable to resolve agent address, keeping %s; %s", r.addr, err)
+		} else {
+			r.addr = addr
+		}
+	}
+
+	var cn statsd.ClientInterface
+	if r.poolSize <= 1 || r.conn != nil {
+		c, err := r.dial()
+		if err != nil {
+			return nil, err
+		}
+		cn = c
+	} else {
+		pool := &clientPool{}
+		for i := 0; i < r.poolSize; i++ {
+			c, err := r.dial()
+			if err != nil {
+				pool.Close()
+				return nil, err
+			}
+			pool.clients = append(pool.clients, c)
+		}
+		cn = pool
+	}
+
+	if r.meterPacking {
+		// The values of meters are buffered in order until the client is
+		// flushed after reporting them
+		meters, err := r.dialWith([]statsd.Option{
+			statsd.WithBufferShardCount(1),
+		})
+		if err != nil {
+			cn.Close()
+			return nil, err
+		}
+		r.meters = meters
+	}
+	return cn, nil
+}
+
+// dial creates a statsd client for the agent address
+func (r *Reporter) dial() (*statsd.Client, error) {
+	opts := []statsd.Option{statsd.WithMaxMessagesPerPayload(FlushLength)}
+	if FlushLength <= 1 {
+		// A single worker keeps datagrams in submission order
+		opts = []statsd.Option{
+			statsd.WithMaxMessagesPerPayload(1),
+			statsd.WithBufferShardCount(1),
+		}
+	}
+
+	return r.dialWith(opts)
+}
+
+// dialWith creates a statsd client for the agent address with the given
+// options
+func (r *Reporter) dialWith(opts []statsd.Option) (cn *statsd.Client, err error) {
+	if r.clientTelemetry {
+		// The client's own telemetry would reset the counts reported by the
+		// reporter
+		opts = append(opts, statsd.WithoutTelemetry())
+	}
+
+	if r.conn != nil {
+		w := &deadlineWriter{Conn: r.conn, timeout: r.writeTimeout}
+		r.ws = append(r.ws, w)
+		cn, err = statsd.NewWithWriter(w, opts...)
+	} else if r.writeTimeout > 0 && r.addr != "" && !strings.HasPrefix(r.addr, "unix://") {
+		var conn net.Conn
+		if conn, err = net.Dial("udp", r.addr); err != nil {
+			return nil, err
+		}
+		w := &deadlineWriter{Conn: conn, timeout: r.writeTimeout}
+		r.ws = append(r.ws, w)
+		cn, err = statsd.NewWithWriter(w, opts...)
+	} else {
+		cn, err = statsd.New(r.addr, opts...)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	if !r.originDetection || !r.features.Has(FeatureOriginDetection) {
+		cn.Tags = withoutTag(cn.Tags, entityIDTag)
+	}
+	if !r.features.Has(FeatureTags) {
+		cn.Tags = nil
+	}
+	cn.Namespace = r.namespace()
+
+	return cn, nil
+}
+
+// String returns a summary of the reporter's configuration, for debugging
+func (r *Reporter) String() string {
+	addr := r.addr
+	if !r.dialed {
+		addr = fmt.Sprintf("client %T", r.cn)
+	} else if r.conn != nil {
+		// Custom connections may have no remote address
+		addr = fmt.Sprintf("conn %T", r.conn)
+		if a := r.conn.RemoteAddr(); a != nil {
+			addr = "conn " + a.String()
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("datadog.Reporter(")
+	if r.name != "" {
+		fmt.Fprintf(&b, "name=%s ", r.name)
+	}
+	fmt.Fprintf(&b, "addr=%s prefix=%q percentiles=%d tags=%d counters=%s",
+		addr, r.prefix, len(r.percentiles), len(r.tags), r.counterMode)
+
+	for _, f := range []struct {
+		name string
+		on   bool
+	}{
+		{"type-tag", r.typeTag},
+		{"instant-meter-rate", r.instantRate},
+		{"meter-delta", r.meterDelta},
+		{"sample-size", r.sampleSize},
+		{"zero-on-removal", r.zeroOnRemoval},
+		{"fail-fast", r.errorMode == FailFast},
+	} {
+		if f.on {
+			b.WriteString(" " + f.name)
+		}
+	}
+
+	b.WriteString(")")
+	return b.String()
+}
+
+// FlushWithInterval repeatedly flushes a snapshot of metrics to Datadog at an
+// interval specified by i, plus any jitter set with WithFlushJitter, until the
+// reporter is closed
+func (r *Reporter) FlushWithInterval(i time.Duration) {
+	r.loopMu.Lock()
+	r.loop.Add(1)
+	r.loopMu.Unlock()
+	defer r.loop.Done()
+
+	r.flushMu.Lock()
+	r.interval = i
+	r.flushMu.Unlock()
+
+	tick := i
+	for _, d := range r.typeIntervals {
+		tick = gcd(tick, d)
+	}
+
+	t := time.NewTimer(tick + r.jitter())
+	defer t.Stop()
+
+	for n := 1; ; n++ {
+		select {
+		case <-t.C:
+			r.flush(r.dueTypes(n, tick, i))
+			t.Reset(tick + r.jitter())
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// elapsed returns the seconds since each go-metrics type was last flushed, and
+// records the types due in the flush at now as flushed. With WithTypeIntervals,
+// types are flushed at their own intervals, so rates are computed over them.
+func (r *Reporter) elapsed(now time.Time) map[string]float64 {
+	if r.lastFlushed == nil {
+		r.lastFlushed = make(map[string]time.Time)
+		for _, origin := range origins {
+			r.lastFlushed[string(origin)] = r.last
+		}
+	}
+
+	res := make(map[string]float64)
+	for _, origin := range origins {
+		o := string(origin)
+		if r.due != nil && !r.due[o] {
+			continue
+		}
+
+		res[o] = now.Sub(r.lastFlushed[o]).Seconds()
+		r.lastFlushed[o] = now
+	}
+	return res
+}
+
+// dueTypes returns the go-metrics types due to be flushed by the nth tick of
+// FlushWithInterval, or nil for all of them, with WithTypeIntervals
+func (r *Reporter) dueTypes(n int, tick, i time.Duration) map[string]bool {
+	if len(r.typeIntervals) == 0 {
+		return nil
+	}
+
+	due := make(map[string]bool)
+	for _, origin := range origins {
+		d, ok := r.typeIntervals[string(origin)]
+		if !ok {
+			d = i
+		}
+		due[string(origin)] = d <= 0 || time.Duration(n)*tick%d == 0
+	}
+	return due
+}
+
+// gcd returns the greatest common divisor of two durations
+func gcd(a, b time.Duration) time.Duration {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// jitter returns a random delay to add to the flush interval, up to the
+// maximum set with WithFlushJitter
+func (r *Reporter) jitter() time.Duration {
+	if r.maxJitter <= 0 {
+		return 0
+	}
+
+	return time.Duration(r.rand.Int63n(int64(r.maxJitter)))
+}
+
+// Close stops FlushWithInterval and closes the client, unless it was set with
+// WithClient and WithCloseClient(false). With WithBlockingFlush, a final
+// snapshot is flushed first, waiting up to CloseTimeout for it to be written
+// to the client's transport. Receipt by the agent can only be assured over
+// connection-oriented transports, not UDP.
+func (r *Reporter) Close() error {
+	r.closing.Do(func() { close(r.stop) })
+	r.stopTrigger()
+	r.loopMu.Lock()
+	r.loop.Wait()
+	r.loopMu.Unlock()
+
+	if r.blockingFlush {
+		done := make(chan error, 1)
+		go func() {
+			// The sender of WithQueueBuffer stops once the final flush is
+			// done, even when it times out
+			err := r.Flush()
+			r.stopQueue()
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				r.closeClient()
+				return err
+			}
+		case <-time.After(CloseTimeout):
+			r.closeClient()
+			return errors.New("datadog: timed out flushing metrics on close")
+		}
+	}
+
+	r.stopQueue()
+	return r.closeClient()
+}
+
+// closeClient closes the client, unless it was set with WithClient and is
+// owned by the caller
+func (r *Reporter) closeClient() error {
+	if !r.dialed && !r.ownsClient {
+		return nil
+	}
+
+	if r.meters != nil {
+		r.meters.Close()
+	}
+	return r.cn.Close()
+}
+
+// Flush submits a snapshot of metrics to Datadog
+func (r *Reporter) Flush() error {
+	return r.flush(nil)
+}
+
+// flush submits a snapshot of the metrics of the due go-metrics types, or of
+// all metrics when nil
+func (r *Reporter) flush(due map[string]bool) error {
+	r.flushMu.Lock()
+	defer r.flushMu.Unlock()
+
+	r.due = due
+	defer func() { r.due = nil }()
+
+	if err := r.submit(); err != nil {
+		return err
+	}
+
+	if err := r.cn.Flush(); err != nil {
+		return err
+	}
+
+	for _, w := range r.ws {
+		if err := w.Err(); err != nil {
+			return err
+		}
+	}
+
+	r.drained = r.now()
+	return nil
+}
+
+// RecordTiming immediately sends a single timing to Datadog, outside of the
+// registry and flush interval
+func (r *Reporter) RecordTiming(name string, d time.Duration, tags ...string) error {
+	tags = r.mergeTags(tags)
+	return r.each(name, func(name string) error { return r.cn.Timing(name, d, tags, 1) })
+}
+
+// Set immediately sends a value of a set to Datadog, which counts the unique
+// values of the set seen in each interval
+func (r *Reporter) Set(name, value string, tags ...string) error {
+	tags = r.mergeTags(tags)
+	return r.each(name, func(name string) error { return r.cn.Set(name, value, tags, 1) })
+}
+
+// Event immediately sends an event to Datadog, with the reporter's tags. Events
+// without a timestamp are given the current time, and the timestamp is
+// corrected by WithTimestampSkew.
+func (r *Reporter) Event(e *statsd.Event) error {
+	ev := r.event(e)
+	return r.cn.Event(&ev)
+}
+
+// event returns a copy of e with the reporter's tags, and its timestamp set
+// and corrected
+func (r *Reporter) event(e *statsd.Event) statsd.Event {
+	ev := *e
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = r.now()
+	}
+	ev.Timestamp = ev.Timestamp.Add(r.skew)
+	if !r.features.Has(FeatureTimestamps) {
+		ev.Timestamp = time.Time{}
+	}
+	ev.Tags = r.mergeTags(e.Tags)
+
+	return ev
+}
+
+func (r *Reporter) submit() (err error) {
+	if r.panicRecovery {
+		defer func() {
+			if v := recover(); v != nil {
+				r.wg.Wait()
+				r.source, r.sourceRegistry = "", 0
+				r.logf("flush panicked: %v", v)
+				err = fmt.Errorf("datadog: flush panicked: %v", v)
+			}
+		}()
+	}
+
+	if r.active != nil && !r.active() {
+		return nil
+	}
+
+	r.err = nil
+	now := r.now()
+	elapsed := r.elapsed(now)
+	r.last = now
+	r.stats = FlushStats{Metrics: make(map[string]int)}
+	r.dropped = make(map[string]int64)
+	r.flushes++
+
+	// Snapshot the registry before sending anything, so that slow sends
+	// don't widen the window for concurrent changes to the registry
+	entries := r.collect()
+
+	// Histograms and timers are only reported every nth flush with
+	// WithHistogramFlushEvery
+	summaries := r.histogramEvery <= 1 || (r.flushes-1)%r.histogramEvery == 0
+
+	for _, e := range entries {
+		if r.due != nil && !r.due[originOf(e.metric)] {
+			continue
+		}
+
+		if !summaries {
+			if origin := originOf(e.metric); origin == "histogram" || origin == "timer" {
+				continue
+			}
+		}
+
+		r.source, r.sourceRegistry = e.tag, e.registry
+		r.guard(e.name, func() {
+			r.report(e.name, e.metric, elapsed[originOf(e.metric)])
+			if r.staleness != nil && r.staleness(e.name) {
+				r.reportStaleness(e.name, e.metric, now)
+			}
+		})
+	}
+	r.source, r.sourceRegistry = "", 0
+
+	if r.meters != nil {
+		r.wg.Wait()
+		r.fail(r.meters.Flush())
+	}
+
+	if r.zeroOnRemoval {
+		r.zeroRemovedGauges(entries)
+	}
+
+	if r.cardinality {
+		r.reportSeriesCounts()
+	}
+
+	if r.healthcheckEvents {
+		r.reportHealthchecks()
+	}
+
+	if r.flushCounter != "" {
+		r.count(r.flushCounter, 1, r.selfTags())
+	}
+
+	if r.bufferAge {
+		r.gauge(bufferAgeMetric, now.Sub(r.drained).Seconds(), r.selfTags())
+	}
+
+	if r.buildInfo != nil {
+		r.gauge(buildInfoMetric, 1, r.mergeTags(r.buildInfo))
+	}
+
+	if r.intervalMetric != "" && r.interval > 0 {
+		r.gauge(r.intervalMetric, r.interval.Seconds(), r.selfTags())
+	}
+
+	if r.startTimeMetric != "" {
+		r.gauge(r.startTimeMetric, float64(r.started.Unix()), r.selfTags())
+	}
+
+	if r.clientTelemetry {
+		r.reportClientTelemetry()
+	}
+
+	if r.goroutineGauge != "" {
+		r.gauge(r.goroutineGauge, float64(r.numGoroutine()), r.selfTags())
+	}
+
+	if r.coalesce {
+		r.drain()
+	}
+
+	if r.droppedCounter {
+		r.countDropped()
+	}
+	r.wg.Wait()
+
+	if r.onFlush != nil {
+		r.stats.Duration = r.now().Sub(now)
+		r.onFlush(r.stats)
+	}
+
+	return r.err
+}
+
+// collect returns snapshots of the metrics to report, merged or renamed when
+// found in several registries
+func (r *Reporter) collect() []entry {
+	if r.aggregator != nil {
+		return r.aggregate()
+	}
+
+	var entries []entry
+	for n, registry := range r.allRegistries() {
+		registry.Each(func(name string, i interface{}) {
+			if r.excluded(name) {
+				r.drop("filter")
+				return
+			}
+
+			r.guard(name, func() {
+				if m := snapshotOf(i); m != nil {
+					entries = append(entries, entry{name: name, metric: m, registry: n})
+				}
+			})
+		})
+	}
+
+	if r.mergeRegistries {
+		return mergeEntries(entries)
+	} else if r.conflictPolicy != ConflictOverwrite {
+		return r.resolveConflicts(entries)
+	}
+	return entries
+}
+
+// aggregate returns snapshots of the metrics returned by the aggregator, in
+// name order
+func (r *Reporter) aggregate() []entry {
+	ms := r.aggregator(r.allRegistries())
+	names := make([]string, 0, len(ms))
+	for name := range ms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var entries []entry
+	for _, name := range names {
+		if r.excluded(name) {
+			r.drop("filter")
+			continue
+		}
+
+		r.guard(name, func() {
+			if m := snapshotOf(ms[name]); m != nil {
+				entries = append(entries, entry{name: name, metric: m})
+			}
+		})
+	}
+	return entries
+}
+
+// excluded returns whether the named metric is excluded by WithNameRegex
+func (r *Reporter) excluded(name string) bool {
+	return r.nameRegex != nil && r.nameRegex.MatchString(name) != r.nameInclude
+}
+
+// guard runs fn for the named metric, logging and dropping the metric if it
+// panics with WithPanicRecovery
+func (r *Reporter) guard(name string, fn func()) {
+	if r.panicRecovery {
+		defer func() {
+			if v := recover(); v != nil {
+				r.logf("reporting %s panicked: %v", name, v)
+				r.drop("panic")
+			}
+		}()
+	}
+
+	fn()
+}
+
+// report sends a snapshot of a single metric to Datadog
+func (r *Reporter) report(name string, i interface{}, elapsed float64) {
+	origin := originOf(i)
+	r.stats.Metrics[origin]++
+	tags := r.tagsFor(name, origin)
+	if r.cardinality {
+		r.trackSeries(name, tags)
+	}
+
+	if r.observed != nil && r.observed(name) {
+		r.gauge(name+".observed", 1, tags)
+	}
+
+	switch metric := i.(type) {
+	case metrics.Counter:
+		v := metric.Count()
+		l := r.ss[r.stateKey(name)]
+		if v == l && r.skipZeroCounters {
+			r.drop("zero")
+		} else if !r.reportKind(name, origin, float64(v-l), elapsed, tags) {
+			switch r.counterMode {
+			case CounterDeltaGauge:
+				r.gauge(name, float64(v-l), tags)
+			case CounterRate:
+				if elapsed > 0 {
+					r.gauge(name, float64(v-l)/elapsed, tags)
+				}
+			default:
+				r.count(name, v-l, tags)
+			}
+		}
+		r.ss[r.stateKey(name)] = v
+
+		if r.counterTotal {
+			r.gauge(name+".total", float64(v), tags)
+		}
+
+		if r.perFlush != nil && r.perFlush(name) {
+			r.reportPerFlush(name, v-l, tags)
+		}
+
+	case metrics.Gauge:
+		v := r.gaugeValue(name, float64(metric.Value()))
+		if !r.reportKind(name, origin, v, elapsed, tags) {
+			r.reportGauge(name, v, tags)
+		}
+
+	case metrics.GaugeFloat64:
+		v := r.gaugeValue(name, metric.Value())
+		if !r.reportKind(name, origin, v, elapsed, tags) {
+			r.reportGauge(name, v, tags)
+		}
+
+	case metrics.Histogram:
+		ms := metric.Snapshot()
+
+		// Duration histograms are converted from nanoseconds to milliseconds,
+		// like timers
+		conv := func(v float64) float64 { return v }
+		variance := ms.Variance()
+		if r.durationHistograms != nil && r.durationHistograms(name) {
+			conv = r.millis
+			variance = r.round(variance / 1e12)
+		}
+
+		if r.sumTotal != nil && r.sumTotal(name) {
+			key := r.stateKey(name + ".sum_total")
+			v := ms.Sum()
+			if l := r.ss[key]; v >= l {
+				r.count(name+".sum_total", v-l, tags)
+			}
+			r.ss[key] = v
+		}
+
+		if r.histogramDist != nil && r.histogramDist(name) {
+			r.histogramDistribution(name, ms, conv, tags)
+			break
+		}
+
+		r.gauge(name+".count", float64(ms.Count()), tags)
+		r.gauge(name+".max", conv(float64(ms.Max())), tags)
+		r.gauge(name+".min", conv(float64(ms.Min())), tags)
+		r.gauge(name+".mean", conv(ms.Mean()), tags)
+		r.gauge(name+".stddev", conv(ms.StdDev()), tags)
+		r.gauge(name+".var", variance, tags)
+
+		if r.sampleSize {
+			r.gauge(name+".sample_size", float64(ms.Sample().Size()), tags)
+		}
+
+		ps, suffixes := r.percentilesFor(name)
+		if len(ps) > 0 && r.enoughSamples(ms.Count()) {
+			for i, v := range ms.Percentiles(ps) {
+				r.gauge(name+suffixes[i], conv(v), tags)
+			}
+		}
+
+		for _, b := range r.percentileBands(ms.Count()) {
+			v := ms.Percentiles([]float64{b.Lo, b.Hi})
+			r.gauge(name+b.suffix(), conv(v[1])-conv(v[0]), tags)
+		}
+
+		if r.iqr && r.enoughSamples(ms.Count()) {
+			v := ms.Percentiles([]float64{0.25, 0.75})
+			r.gauge(name+".iqr", conv(v[1])-conv(v[0]), tags)
+		}
+
+		if r.mad && r.enoughSamples(ms.Count()) {
+			r.gauge(name+".mad", conv(medianAbsoluteDeviation(ms.Sample().Values())), tags)
+		}
+
+	case metrics.Meter:
+		r.reportMeter(name, metric.Snapshot(), elapsed, tags)
+
+	case metrics.Timer:
+		ms := metric.Snapshot()
+		ps, suffixes := r.percentilesFor(name)
+
+		if r.timerMode != TimerDistribution {
+			r.gauge(name+".count", float64(ms.Count()), tags)
+			r.gauge(name+".max", r.millis(float64(ms.Max())), tags)
+			r.gauge(name+".min", r.millis(float64(ms.Min())), tags)
+			r.gauge(name+".mean", r.millis(ms.Mean()), tags)
+			r.gauge(name+".stddev", r.millis(ms.StdDev()), tags)
+
+			if len(ps) > 0 && r.enoughSamples(ms.Count()) {
+				for i, v := range ms.Percentiles(ps) {
+					r.gauge(name+suffixes[i], r.millis(v), tags)
+				}
+			}
+
+			for _, b := range r.percentileBands(ms.Count()) {
+				v := ms.Percentiles([]float64{b.Lo, b.Hi})
+				r.gauge(name+b.suffix(), r.millis(v[1])-r.millis(v[0]), tags)
+			}
+
+			if r.iqr && r.enoughSamples(ms.Count()) {
+				v := ms.Percentiles([]float64{0.25, 0.75})
+				r.gauge(name+".iqr", r.millis(v[1])-r.millis(v[0]), tags)
+			}
+		}
+
+		if r.timerOps {
+			key := r.stateKey(name + r.timerOpsSuffix)
+			v := ms.Count()
+			r.count(name+r.timerOpsSuffix, v-r.ss[key], tags)
+			r.ss[key] = v
+		}
+
+		switch r.timerMode {
+		case TimerDistribution:
+			r.timerDistribution(name, ms, ps, tags)
+		case TimerSummaryAndDistribution:
+			r.timerDistribution(name+".dist", ms, ps, tags)
+		}
+	}
+}
+
+// trackSeries records the tags with which the named metric is reported in the
+// flush
+func (r *Reporter) trackSeries(name string, tags []string) {
+	if r.tagSets == nil {
+		r.tagSets = make(map[string]map[string]struct{})
+	}
+	if r.tagSets[name] == nil {
+		r.tagSets[name] = make(map[string]struct{})
+	}
+
+	sorted := append([]string(nil), tags...)
+	sort.Strings(sorted)
+	r.tagSets[name][strings.Join(sorted, ",")] = struct{}{}
+}
+
+// reportSeriesCounts sends the number of distinct tag sets with which each
+// metric was reported in the flush as name.series_count
+func (r *Reporter) reportSeriesCounts() {
+	names := make([]string, 0, len(r.tagSets))
+	for name := range r.tagSets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		r.gauge(name+".series_count", float64(len(r.tagSets[name])), r.mergeTags(nil))
+	}
+	r.tagSets = nil
+}
+
+// newSample returns a sample for a histogram created by the reporter, of n
+// values by default, n being positive
+func (r *Reporter) newSample() metrics.Sample {
+	if r.defaultSample != nil {
+		return r.defaultSample()
+	}
+
+	return metrics.NewExpDecaySample(r.perFlushWindow, sampleAlpha)
+}
+
+// sampleAlpha is the decay of the default sample, that of the samples of
+// go-metrics timers
+const sampleAlpha = 0.015
+
+// reportClientTelemetry sends the counts of the client's telemetry since the
+// previous flush, when the client supports it
+func (r *Reporter) reportClientTelemetry() {
+	cn, ok := r.cn.(TelemetryClient)
+	if !ok {
+		return
+	}
+
+	m := cn.FlushTelemetryMetrics()
+	tags := r.selfTags()
+	r.count("datadog_reporter.client.metrics", int64(m.TotalMetrics), tags)
+	r.count("datadog_reporter.client.events", int64(m.TotalEvents), tags)
+	r.count("datadog_reporter.client.service_checks", int64(m.TotalServiceChecks), tags)
+	r.count("datadog_reporter.client.dropped_on_receive", int64(m.TotalDroppedOnReceive), tags)
+}
+
+// gauge sends a gauge to Datadog, or buffers it when coalescing gauges.
+// Values that are not finite can't be represented and are dropped.
+func (r *Reporter) gauge(name string, v float64, tags []string) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		r.drop("non_finite")
+		return
+	}
+
+	if r.coalesce {
+		r.buffer(name, v, tags)
+		return
+	}
+
+	r.sendGauge(name, v, tags)
+}
+
+// sendGauge sends a gauge to Datadog
+func (r *Reporter) sendGauge(name string, v float64, tags []string) {
+	r.emit(Emission{name, v, GaugeType, tags})
+}
+
+// distribution sends a value of a distribution to Datadog
+func (r *Reporter) distribution(name string, v float64, tags []string) {
+	r.emit(Emission{name, v, DistributionType, tags})
+}
+
+// histogram sends a value of a histogram to Datadog, aggregated by the agent
+func (r *Reporter) histogram(name string, v float64, tags []string) {
+	r.emit(Emission{name, v, HistogramType, tags})
+}
+
+// count sends a count to Datadog
+func (r *Reporter) count(name string, v int64, tags []string) {
+	r.emit(Emission{name, float64(v), CountType, tags})
+}
+
+// emit sends a metric to Datadog and writes it to the file sink, once passed
+// through the filter set with WithPreSendFilter
+func (r *Reporter) emit(e Emission) {
+	if r.stopped() {
+		return
+	}
+
+	if r.preSend != nil {
+		e.Tags = append([]string(nil), e.Tags...)
+		if !r.preSend(&e) {
+			r.drop("pre_send")
+			return
+		}
+	}
+	r.degrade(&e)
+
+	name, v, tags := e.Name, e.Value, e.Tags
+	cn := r.cn
+	if r.batch != nil {
+		cn = r.batch
+	}
+
+	switch e.Type {
+	case CountType:
+		n := int64(math.Round(v))
+		v = float64(n)
+		r.send(name, func(name string) error { return cn.Count(name, n, tags, 1) })
+	case DistributionType:
+		r.send(name, func(name string) error { return cn.Distribution(name, v, tags, 1) })
+	case HistogramType:
+		r.send(name, func(name string) error { return cn.Histogram(name, v, tags, 1) })
+	default:
+		r.send(name, func(name string) error { return cn.Gauge(name, v, tags, 1) })
+	}
+	r.write(name, v, e.Type, tags)
+}
+
+// emitEvent sends an event about the named metric during a flush, titled with
+// the prefixed name of the metric followed by title, once per prefix with a
+// secondary prefix. It is first passed through the filter set with
+// WithPreSendFilter, as an emission of EventType.
+func (r *Reporter) emitEvent(name, title string, e *statsd.Event) {
+	if r.stopped() {
+		return
+	}
+
+	ev := r.event(e)
+	if r.preSend != nil {
+		em := Emission{name, 0, EventType, append([]string(nil), ev.Tags...)}
+		if !r.preSend(&em) {
+			r.drop("pre_send")
+			return
+		}
+		name, ev.Tags = em.Name, em.Tags
+	}
+
+	prefixes := []string{r.prefix}
+	if r.secondaryPrefix != "" {
+		prefixes = append(prefixes, r.secondaryPrefix)
+	}
+
+	cn := r.cn
+	for _, prefix := range prefixes {
+		ev := ev
+		ev.Title = prefix + name + title
+		r.dispatch(func() error { return cn.Event(&ev) })
+	}
+}
+
+// drop records a value suppressed for the given reason
+func (r *Reporter) drop(reason string) {
+	if r.dropped == nil {
+		r.dropped = make(map[string]int64)
+	}
+	r.dropped[reason]++
+}
+
+// countDropped reports the number of values suppressed by the flush, by
+// reason
+func (r *Reporter) countDropped() {
+	reasons := make([]string, 0, len(r.dropped))
+	for reason := range r.dropped {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	for _, reason := range reasons {
+		tags := append(append([]string(nil), r.selfTags()...), "reason:"+reason)
+		r.count(droppedMetric, r.dropped[reason], tags)
+	}
+}
+
+// namespace returns the namespace of the clients created by the reporter. With
+// a secondary prefix, the prefixes are added to the metric names instead.
+func (r *Reporter) namespace() string {
+	if r.secondaryPrefix != "" {
+		return ""
+	}
+	return r.prefix
+}
+
+// clientNamespace returns the namespace the client adds to metric names: that
+// of a *statsd.Client set with WithClient when WithClientNamespaceUnmanaged is
+// set, and the namespace set by the reporter otherwise
+func (r *Reporter) clientNamespace() string {
+	if cn, ok := r.cn.(*statsd.Client); ok && r.unmanagedNamespace && !r.dialed {
+		return cn.Namespace
+	}
+	return r.namespace()
+}
+
+// send dispatches a metric once, or once per prefix with a secondary prefix
+func (r *Reporter) send(name string, fn func(name string) error) {
+	if r.secondaryPrefix == "" {
+		r.dispatch(func() error { return fn(name) })
+		return
+	}
+
+	for _, prefix := range [...]string{r.prefix, r.secondaryPrefix} {
+		name := prefix + name
+		r.dispatch(func() error { return fn(name) })
+	}
+}
+
+// each immediately sends a metric once, or once per prefix with a secondary
+// prefix, returning the first error
+func (r *Reporter) each(name string, fn func(name string) error) error {
+	if r.secondaryPrefix == "" {
+		return fn(name)
+	}
+
+	err := fn(r.prefix + name)
+	if err2 := fn(r.secondaryPrefix + name); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// dispatch runs send, in the sender goroutine when WithQueueBuffer is set, or
+// in its own goroutine when WithMaxInflight is set
+func (r *Reporter) dispatch(send func() error) {
+	if r.queue != nil && !r.queueClosed {
+		r.enqueue(send)
+		return
+	}
+
+	r.stats.Emissions++
+
+	if r.inflight == nil {
+		r.fail(send())
+		return
+	}
+
+	r.inflight <- struct{}{}
+	r.wg.Add(1)
+	go func() {
+		defer func() {
+			<-r.inflight
+			r.wg.Done()
+		}()
+
+		r.fail(send())
+	}()
+}
+
+// fail records an error of the current flush. The first error is returned by
+// submit.
+func (r *Reporter) fail(err error) {
+	if err == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stats.Errors++
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// stopped returns whether the current flush failed with FailFast, and sends
+// nothing more
+func (r *Reporter) stopped() bool {
+	if r.errorMode != FailFast {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.err != nil
+}
+
+// write renders a metric to the file sink, if one is configured
+func (r *Reporter) write(name string, v float64, typ MetricType, tags []string) {
+	if r.sink == nil {
+		return
+	}
+
+	// Names are written as they are sent, with the namespace of the client
+	ns := r.clientNamespace()
+	if r.secondaryPrefix == "" {
+		r.writeLine(ns+name, v, typ, tags)
+		return
+	}
+
+	r.writeLine(ns+r.prefix+name, v, typ, tags)
+	r.writeLine(ns+r.secondaryPrefix+name, v, typ, tags)
+}
+
+// writeLine renders a metric with its full name to the file sink
+func (r *Reporter) writeLine(name string, v float64, typ MetricType, tags []string) {
+	var line []byte
+	if r.render != nil {
+		line = r.render(name, v, typ, tags)
+	} else {
+		r.buf = appendMetric(r.buf[:0], name, v, typ, tags)
+		line = r.buf
+	}
+
+	_, err := r.sink.Write(line)
+	r.fail(err)
+}
+
+// millis converts a duration in nanoseconds to milliseconds, rounded to the
+// configured timer precision
+func (r *Reporter) millis(ns float64) float64 {
+	return r.round(time.Duration(ns).Seconds() * 1000)
+}
+
+// round rounds v to the configured timer precision
+func (r *Reporter) round(v float64) float64 {
+	return roundTo(v, r.timerPrecision)
+}
+
+// roundTo rounds v to the given number of decimal places, unless negative
+func roundTo(v float64, digits int) float64 {
+	if digits >= 0 {
+		p := math.Pow10(digits)
+		v = math.Round(v*p) / p
+	}
+
+	return v
+}
+
+// entry is a metric of a registry
+type entry struct {
+	name     string
+	metric   interface{}
+	registry int
+	tag      string
+}
+
+// snapshotOf returns a read-only copy of i, or nil for unsupported types
+func snapshotOf(i interface{}) interface{} {
+	switch metric := i.(type) {
+	case metrics.Counter:
+		return metric.Snapshot()
+	case metrics.Gauge:
+		return metric.Snapshot()
+	case metrics.GaugeFloat64:
+		return metric.Snapshot()
+	case metrics.Histogram:
+		return metric.Snapshot()
+	case metrics.Meter:
+		return metric.Snapshot()
+	case metrics.Timer:
+		return metric.Snapshot()
+	}
+
+	return nil
+}
+
+// originOf returns the name of the go-metrics type of i, or an empty string
+// for unsupported types
+func originOf(i interface{}) string {
+	switch i.(type) {
+	case metrics.Counter:
+		return "counter"
+	case metrics.Gauge, metrics.GaugeFloat64:
+		return "gauge"
+	case metrics.Histogram:
+		return "histogram"
+	case metrics.Meter:
+		return "meter"
+	case metrics.Timer:
+		return "timer"
+	}
+
+	return ""
+}
+
+// withoutTag returns tags without those with the given key
+func withoutTag(tags []string, key string) []string {
+	var res []string
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, key+":") {
+			res = append(res, tag)
+		}
+	}
+
+	return res
+}
+
+// mergeTags returns the global tags followed by tags, or none when tags aren't
+// supported
+func (r *Reporter) mergeTags(tags []string) []string {
+	if !r.features.Has(FeatureTags) {
+		return nil
+	}
+	if len(tags) == 0 {
+		return r.limitTags(r.tags)
+	}
+
+	res := make([]string, 0, len(r.tags)+len(tags))
+	res = append(res, r.tags...)
+	return r.limitTags(append(res, tags...))
+}
+
+// limitTags returns tags with the values longer than WithMaxTagValueLength
+// truncated, logging each truncated tag once. The tags are returned as they
+// are when none is too long.
+func (r *Reporter) limitTags(tags []string) []string {
+	if r.maxTagValue <= 0 {
+		return tags
+	}
+
+	var res []string
+	for i, tag := range tags {
+		j := strings.IndexByte(tag, ':') + 1
+		if len(tag)-j <= r.maxTagValue {
+			continue
+		}
+
+		if res == nil {
+			res = append([]string(nil), tags...)
+		}
+		// Truncate at the start of a character, to keep tags valid UTF-8
+		k := j + r.maxTagValue
+		for k > j && !utf8.RuneStart(tag[k]) {
+			k--
+		}
+		res[i] = tag[:k]
+
+		r.mu.Lock()
+		if r.truncated == nil {
+			r.truncated = make(map[string]struct{})
+		}
+		_, logged := r.truncated[tag]
+		r.truncated[tag] = struct{}{}
+		r.mu.Unlock()
+		if !logged {
+			r.logf("truncating tag value longer than %d bytes: %s", r.maxTagValue, res[i])
+		}
+	}
+
+	if res == nil {
+		return tags
+	}
+	return res
+}
+
+// selfTags returns the tags for metrics about the reporter itself
+func (r *Reporter) selfTags() []string {
+	if r.name == "" {
+		return r.limitTags(r.tags)
+	}
+
+	return r.mergeTags([]string{"reporter:" + r.name})
+}
+
+// logf logs a problem, identifying the reporter by name if it has one
+func (r *Reporter) logf(format string, v ...interface{}) {
+	if r.name != "" {
+		format = "datadog " + r.name + ": " + format
+	} else {
+		format = "datadog: " + format
+	}
+
+	r.logger.Printf(format, v...)
+}
+
+// tagsFor returns the tags for the named metric of the given go-metrics type,
+// from the current source
+func (r *Reporter) tagsFor(name, origin string) []string {
+	desc, described := r.descriptions[name]
+	if !r.typeTag && r.source == "" && r.shardKey == "" && !described {
+		return r.limitTags(r.tags)
+	}
+
+	tags := make([]string, len(r.tags), len(r.tags)+4)
+	copy(tags, r.tags)
+	if r.typeTag {
+		tags = append(tags, "dd_metric_origin:"+origin)
+	}
+	if r.source != "" {
+		tags = append(tags, r.source)
+	}
+	if r.shardKey != "" {
+		tags = append(tags, r.shardKey+":"+strconv.Itoa(r.shard(name)))
+	}
+	if described {
+		tags = append(tags, "desc:"+desc)
+	}
+	return r.limitTags(tags)
+}
+
+// shard returns the shard of the named metric with WithShardTag
+func (r *Reporter) shard(name string) int {
+	var h int
+	if r.shardHash != nil {
+		h = r.shardHash(name)
+	} else {
+		f := fnv.New32a()
+		f.Write([]byte(name))
+		h = int(f.Sum32())
+	}
+
+	if h %= r.shards; h < 0 {
+		h += r.shards
+	}
+	return h
 }
@@ -1,13 +1,25 @@
 package datadog
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
 	"net"
 	"os"
 	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 
+	"github.com/DataDog/datadog-go/statsd"
 	"github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/assert"
 )
@@ -18,9 +30,13 @@ const addr = "127.0.0.1:9999"
 
 // testWaitTimeout determines how long to wait for a result. Configured by
 // setting the TEST_TIMEOUT environment variable
-var testWaitTimeout = 1 * time.Millisecond
+var testWaitTimeout = 50 * time.Millisecond
 
 func newServer(t *testing.T, c int) chan []byte {
+	return newServerAt(t, addr, c)
+}
+
+func newServerAt(t *testing.T, addr string, c int) chan []byte {
 	ch := make(chan []byte, 64)
 
 	cn, err := net.ListenPacket("udp", addr)
@@ -33,14 +49,14 @@ func newServer(t *testing.T, c int) chan []byte {
 
 		for ; c > 0; c-- {
 			cn.SetReadDeadline(time.Now().Add(testWaitTimeout << 1))
-			buf := make([]byte, 128)
+			buf := make([]byte, 1500)
 			n, _, err := cn.ReadFrom(buf)
 			if err != nil {
-				t.Fatalf("unable to read data; %s", err)
+				t.Errorf("unable to read data; %s", err)
 				return
 			}
 
-			ch <- buf[:n]
+			ch <- bytes.TrimSuffix(buf[:n], []byte("\n"))
 		}
 	}()
 
@@ -71,6 +87,51 @@ func TestNew_WithAddress(t *testing.T) {
 	assert.Equal(t, "127.0.0.2:8125", r.addr)
 }
 
+func TestNew_WithPrefix(t *testing.T) {
+	r, _ := New(WithPrefix("app"))
+	assert.Equal(t, "app.", r.prefix)
+
+	r, _ = New(WithPrefix("app."))
+	assert.Equal(t, "app.", r.prefix)
+
+	r, _ = New(WithPrefix(""))
+	assert.Equal(t, "", r.prefix)
+}
+
+func TestReporter_FlushWithEmptyPrefix(t *testing.T) {
+	ch := newServer(t, 1)
+
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredCounter("foo", r).Inc(1)
+
+	dd, _ := New(WithAddress(addr), WithRegistry(r), WithPrefix(""))
+	dd.Flush()
+
+	assert.Equal(t, []string{"foo:1|c"}, receive(t, ch, 1))
+}
+
+func TestNew_WithOriginDetection(t *testing.T) {
+	t.Setenv("DD_ENTITY_ID", "pod-uid")
+
+	for _, tt := range []struct {
+		enabled bool
+		e       string
+	}{
+		{true, "foo:1|c|#dd.internal.entity_id:pod-uid"},
+		{false, "foo:1|c"},
+	} {
+		ch := newServer(t, 1)
+
+		r := metrics.NewRegistry()
+		metrics.NewRegisteredCounter("foo", r).Inc(1)
+
+		dd, _ := New(WithAddress(addr), WithRegistry(r), WithOriginDetection(tt.enabled))
+		dd.Flush()
+
+		assert.Equal(t, []string{tt.e}, receive(t, ch, 1))
+	}
+}
+
 func TestReporter_FlushCounter(t *testing.T) {
 	ch := newServer(t, 2)
 
@@ -102,40 +163,101 @@ func TestReporter_FlushCounter(t *testing.T) {
 	}
 }
 
-func TestReporter_FlushGauge(t *testing.T) {
-	ch := newServer(t, 1)
+func TestReporter_FlushCounter_DeltaGauge(t *testing.T) {
+	ch := newServer(t, 2)
 
 	r := metrics.NewRegistry()
-	c := metrics.NewRegisteredGauge("foo", r)
-	c.Update(100)
+	c := metrics.NewRegisteredCounter("foo", r)
+	dd, _ := New(WithAddress(addr), WithRegistry(r), WithCounterMode(CounterDeltaGauge))
 
-	dd, _ := New(WithAddress(addr), WithRegistry(r))
+	c.Inc(2)
+	dd.Flush()
+	c.Inc(3)
 	dd.Flush()
-	select {
-	case d := <-ch:
-		assert.Equal(t, "foo:100.000000|g", string(d))
 
-	case <-time.After(testWaitTimeout):
-		assert.Fail(t, "timeout")
-	}
+	assert.Equal(t, []string{"foo:2|g", "foo:3|g"}, receive(t, ch, 2))
 }
 
-func TestReporter_FlushGaugeFloat64(t *testing.T) {
-	ch := newServer(t, 1)
+func TestReporter_FlushCounter_Rate(t *testing.T) {
+	ch := newServer(t, 2)
 
 	r := metrics.NewRegistry()
-	c := metrics.NewRegisteredGaugeFloat64("foo", r)
-	c.Update(55.55)
+	c := metrics.NewRegisteredCounter("foo", r)
 
-	dd, _ := New(WithAddress(addr), WithRegistry(r))
+	now := time.Unix(1000, 0)
+	dd, _ := New(WithAddress(addr), WithRegistry(r), WithCounterMode(CounterRate))
+	dd.now = func() time.Time { return now }
+	dd.last = now
+
+	c.Inc(10)
+	now = now.Add(4 * time.Second)
 	dd.Flush()
-	select {
-	case d := <-ch:
-		assert.Equal(t, "foo:55.550000|g", string(d))
 
-	case <-time.After(testWaitTimeout):
-		assert.Fail(t, "timeout")
+	c.Inc(3)
+	now = now.Add(2 * time.Second)
+	dd.Flush()
+
+	assert.Equal(t, []string{"foo:2.5|g", "foo:1.5|g"}, receive(t, ch, 2))
+}
+
+func TestReporter_FlushWithCounterDualEmit(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredCounter("foo", r)
+
+	dd, buf := newTestReporter(t, r, WithCounterDualEmit(true))
+
+	c.Inc(5)
+	dd.Flush()
+	c.Inc(3)
+	dd.Flush()
+
+	assert.Equal(t, "foo:5|c\nfoo.total:5|g\nfoo:3|c\nfoo.total:8|g\n", buf.String())
+}
+
+func TestReporter_FlushWithActiveWindow(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredCounter("foo", r)
+
+	active := true
+	var flushes int
+	dd, buf := newTestReporter(t, r,
+		WithActiveWindow(func() bool { return active }), WithOnFlush(func(FlushStats) { flushes++ }))
+
+	for _, a := range []bool{true, false, false, true} {
+		active = a
+		c.Inc(1)
+		assert.NoError(t, dd.Flush())
+	}
+
+	assert.Equal(t, "foo:1|c\nfoo:3|c\n", buf.String())
+	assert.Equal(t, 2, flushes)
+}
+
+func TestReporter_FlushWithDefaultSample(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredCounter("requests", r)
+
+	var samples []metrics.Sample
+	dd, buf := newTestReporter(t, r,
+		WithPercentiles([]float64{0.5}), WithPercentileNames(map[float64]string{0.5: ".p50"}),
+		WithPerFlushPercentiles(func(name string) bool { return true }, 4),
+		WithDefaultSample(func() metrics.Sample {
+			s := metrics.NewUniformSample(100)
+			samples = append(samples, s)
+			return s
+		}))
+
+	for _, d := range []int64{1000, 10, 20, 5, 100} {
+		buf.Reset()
+		c.Inc(d)
+		dd.Flush()
+	}
+
+	// The uniform sample keeps all deltas, beyond the default 4
+	if assert.Len(t, samples, 1) {
+		assert.Equal(t, int64(5), samples[0].Count())
 	}
+	assert.Equal(t, "requests:100|c\nrequests.per_flush.p50:20|g\n", buf.String())
 }
 
 func TestReporter_FlushHistogram(t *testing.T) {
@@ -162,21 +284,85 @@ func TestReporter_FlushHistogram(t *testing.T) {
 	}
 
 	e := []string{
-		"foo.count:2.000000|g",
-		"foo.max:11.000000|g",
-		"foo.min:1.000000|g",
-		"foo.mean:6.000000|g",
-		"foo.stddev:5.000000|g",
-		"foo.var:25.000000|g",
-		"foo.pct-50.00:6.000000|g",
-		"foo.pct-75.00:11.000000|g",
-		"foo.pct-95.00:11.000000|g",
-		"foo.pct-99.00:11.000000|g",
-		"foo.pct-99.90:11.000000|g",
+		"foo.count:2|g",
+		"foo.max:11|g",
+		"foo.min:1|g",
+		"foo.mean:6|g",
+		"foo.stddev:5|g",
+		"foo.var:25|g",
+		"foo.pct-50.00:6|g",
+		"foo.pct-75.00:11|g",
+		"foo.pct-95.00:11|g",
+		"foo.pct-99.00:11|g",
+		"foo.pct-99.90:11|g",
 	}
 	assert.Equal(t, e, res)
 }
 
+func TestReporter_FlushHistogram_WithSampleSize(t *testing.T) {
+	n := 7
+	ch := newServer(t, n)
+
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredHistogram("foo", r, metrics.NewUniformSample(4))
+	for i := int64(1); i <= 10; i++ {
+		c.Update(i)
+	}
+
+	dd, _ := New(WithAddress(addr), WithRegistry(r), WithPercentiles(nil), WithSampleSize(true))
+	dd.Flush()
+
+	res := receive(t, ch, n)
+	assert.Equal(t, "foo.count:10|g", res[0])
+	assert.Equal(t, "foo.sample_size:4|g", res[6])
+}
+
+func TestReporter_FlushHistogram_WithDurationHistograms(t *testing.T) {
+	r := metrics.NewRegistry()
+	for _, name := range []string{"latency", "size"} {
+		c := metrics.NewRegisteredHistogram(name, r, metrics.NewUniformSample(4))
+		c.Update(int64(time.Millisecond))
+		c.Update(int64(3 * time.Millisecond))
+	}
+
+	dd, buf := newTestReporter(t, r,
+		WithPercentiles([]float64{0.5}),
+		WithDurationHistograms(func(name string) bool { return name == "latency" }))
+	dd.Flush()
+
+	for _, e := range []string{
+		"latency.max:3|g",
+		"latency.min:1|g",
+		"latency.mean:2|g",
+		"latency.stddev:1|g",
+		"latency.var:1|g",
+		"latency.pct-50.00:2|g",
+		"size.max:3000000|g",
+		"size.pct-50.00:2000000|g",
+	} {
+		assert.Contains(t, buf.String(), e+"\n")
+	}
+}
+
+func TestReporter_FlushWithHistogramFlushEvery(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredHistogram("foo", r, metrics.NewUniformSample(4)).Update(1)
+	metrics.NewRegisteredTimer("bar", r).Update(time.Millisecond)
+	metrics.NewRegisteredGauge("baz", r).Update(1)
+
+	dd, buf := newTestReporter(t, r, WithPercentiles(nil), WithHistogramFlushEvery(3))
+
+	for i := 1; i <= 5; i++ {
+		buf.Reset()
+		dd.Flush()
+
+		reported := i == 1 || i == 4
+		assert.Equal(t, reported, strings.Contains(buf.String(), "foo.count:1|g\n"), "flush %d", i)
+		assert.Equal(t, reported, strings.Contains(buf.String(), "bar.count:1|g\n"), "flush %d", i)
+		assert.Contains(t, buf.String(), "baz:1|g\n")
+	}
+}
+
 func TestReporter_FlushTimer(t *testing.T) {
 	n := 10
 	ch := newServer(t, n)
@@ -203,16 +389,16 @@ func TestReporter_FlushTimer(t *testing.T) {
 	}
 
 	e := []string{
-		"foo.count:10.000000|g",
-		"foo.max:10.000000|g",
-		"foo.min:1.000000|g",
-		"foo.mean:1.900000|g",
-		"foo.stddev:2.700000|g",
-		"foo.pct-50.00:1.000000|g",
-		"foo.pct-75.00:1.000000|g",
-		"foo.pct-95.00:10.000000|g",
-		"foo.pct-99.00:10.000000|g",
-		"foo.pct-99.90:10.000000|g",
+		"foo.count:10|g",
+		"foo.max:10|g",
+		"foo.min:1|g",
+		"foo.mean:1.9|g",
+		"foo.stddev:2.7|g",
+		"foo.pct-50.00:1|g",
+		"foo.pct-75.00:1|g",
+		"foo.pct-95.00:10|g",
+		"foo.pct-99.00:10|g",
+		"foo.pct-99.90:10|g",
 	}
 	assert.Equal(t, e, res)
 }
@@ -243,30 +429,71 @@ func TestReporter_FlushTimer_NoPercentiles(t *testing.T) {
 	}
 
 	e := []string{
-		"foo.count:10.000000|g",
-		"foo.max:10.000000|g",
-		"foo.min:1.000000|g",
-		"foo.mean:1.900000|g",
-		"foo.stddev:2.700000|g",
+		"foo.count:10|g",
+		"foo.max:10|g",
+		"foo.min:1|g",
+		"foo.mean:1.9|g",
+		"foo.stddev:2.7|g",
 	}
 	assert.Equal(t, e, res)
 }
 
-func TestReporter_FlushMeter(t *testing.T) {
+func TestReporter_FlushTimer_WithPrecision(t *testing.T) {
+	n := 6
+	ch := newServer(t, n)
+
 	r := metrics.NewRegistry()
-	c := metrics.NewRegisteredMeter("foo", r)
+	c := metrics.NewRegisteredTimer("foo", r)
 
-	for i := 0; i < 10; i++ {
-		c.Mark(1)
-		time.Sleep(1 * time.Millisecond)
+	for _, v := range []time.Duration{1000, 1000, 2001} {
+		c.Update(v * time.Microsecond)
 	}
 
-	n := 5
-	ch := newServer(t, n)
+	dd, _ := New(WithAddress(addr), WithRegistry(r),
+		WithPercentiles([]float64{0.5}), WithTimerPrecision(2))
+	dd.Flush()
 
-	dd, _ := New(WithAddress(addr), WithRegistry(r))
+	e := []string{
+		"foo.count:3|g",
+		"foo.max:2|g",
+		"foo.min:1|g",
+		"foo.mean:1.33|g",
+		"foo.stddev:0.47|g",
+		"foo.pct-50.00:1|g",
+	}
+	assert.Equal(t, e, receive(t, ch, n))
+}
+
+func TestReporter_FlushTimer_SummaryAndDistribution(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredTimer("foo", r)
+
+	for _, v := range []time.Duration{1, 1, 1, 1, 1, 1, 1, 1, 1, 10} {
+		c.Update(v * time.Millisecond)
+	}
+
+	dd, buf := newTestReporter(t, r,
+		WithPercentiles([]float64{0.5, 0.95}), WithTimerMode(TimerSummaryAndDistribution))
+	dd.Flush()
 	dd.Flush()
 
+	e := "foo.count:10|g\n" +
+		"foo.max:10|g\n" +
+		"foo.min:1|g\n" +
+		"foo.mean:1.9|g\n" +
+		"foo.stddev:2.7|g\n" +
+		"foo.pct-50.00:1|g\n" +
+		"foo.pct-95.00:10|g\n" +
+		"foo.dist:1|d\n" +
+		"foo.dist:10|d\n"
+	assert.Equal(t, e, buf.String()[:len(e)])
+
+	// The distribution isn't sent again without updates
+	assert.Equal(t, 2, strings.Count(buf.String(), "|d"))
+}
+
+// receive collects n datagrams from ch, failing the test on timeout
+func receive(t *testing.T, ch chan []byte, n int) []string {
 	var res []string
 	for i := 0; i < n; i++ {
 		select {
@@ -278,12 +505,993 @@ func TestReporter_FlushMeter(t *testing.T) {
 		}
 	}
 
+	return res
+}
+
+func TestReporter_FlushWithTypeTag(t *testing.T) {
+	tests := []struct {
+		origin   string
+		n        int
+		register func(r metrics.Registry)
+	}{
+		{"counter", 1, func(r metrics.Registry) { metrics.NewRegisteredCounter("foo", r).Inc(1) }},
+		{"gauge", 1, func(r metrics.Registry) { metrics.NewRegisteredGauge("foo", r).Update(1) }},
+		{"gauge", 1, func(r metrics.Registry) { metrics.NewRegisteredGaugeFloat64("foo", r).Update(1) }},
+		{"histogram", 11, func(r metrics.Registry) {
+			metrics.NewRegisteredHistogram("foo", r, metrics.NewUniformSample(4)).Update(1)
+		}},
+		{"meter", 5, func(r metrics.Registry) { metrics.NewRegisteredMeter("foo", r).Mark(1) }},
+		{"timer", 10, func(r metrics.Registry) { metrics.NewRegisteredTimer("foo", r).Update(time.Millisecond) }},
+	}
+
+	for _, tt := range tests {
+		ch := newServer(t, tt.n)
+
+		r := metrics.NewRegistry()
+		tt.register(r)
+
+		dd, _ := New(WithAddress(addr), WithRegistry(r), WithTypeTag(true))
+		dd.Flush()
+
+		for _, d := range receive(t, ch, tt.n) {
+			assert.Regexp(t, `^foo[^|]*:[^|]+\|[cg]\|#dd_metric_origin:`+tt.origin+`$`, d)
+		}
+	}
+}
+
+func TestReporter_FlushWithFileSink(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredHistogram("foo", r, metrics.NewExpDecaySample(4, 1.0))
+	c.Update(11)
+	c.Update(1)
+
+	var buf bytes.Buffer
+	dd, _ := New(WithAddress(addr), WithRegistry(r), WithPrefix("app"),
+		WithPercentiles([]float64{0.5}), WithFileSink(&buf))
+	assert.NoError(t, dd.Flush())
+
+	e := "app.foo.count:2|g\n" +
+		"app.foo.max:11|g\n" +
+		"app.foo.min:1|g\n" +
+		"app.foo.mean:6|g\n" +
+		"app.foo.stddev:5|g\n" +
+		"app.foo.var:25|g\n" +
+		"app.foo.pct-50.00:6|g\n"
+	assert.Equal(t, e, buf.String())
+}
+
+// blockingClient is a statsd client whose sends block until released
+type blockingClient struct {
+	statsd.NoOpClient
+	release  chan struct{}
+	inflight int32
+	max      int32
+	sent     int32
+}
+
+func (c *blockingClient) Gauge(name string, value float64, tags []string, rate float64) error {
+	n := atomic.AddInt32(&c.inflight, 1)
+	for {
+		m := atomic.LoadInt32(&c.max)
+		if n <= m || atomic.CompareAndSwapInt32(&c.max, m, n) {
+			break
+		}
+	}
+
+	<-c.release
+	atomic.AddInt32(&c.inflight, -1)
+	atomic.AddInt32(&c.sent, 1)
+	return nil
+}
+
+func TestReporter_FlushWithMaxInflight(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredTimer("foo", r)
+	c.Update(time.Millisecond)
+
+	cn := &blockingClient{release: make(chan struct{})}
+	dd, _ := New(WithClient(cn), WithRegistry(r), WithMaxInflight(3))
+
+	done := make(chan error)
+	go func() { done <- dd.Flush() }()
+
+	for i := 0; i < 10; i++ {
+		time.Sleep(time.Millisecond)
+		assert.LessOrEqual(t, atomic.LoadInt32(&cn.inflight), int32(3))
+		cn.release <- struct{}{}
+	}
+
+	assert.NoError(t, <-done)
+	assert.Equal(t, int32(10), atomic.LoadInt32(&cn.sent))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&cn.max))
+}
+
+// failingClient is a statsd client whose counts fail
+type failingClient struct {
+	statsd.NoOpClient
+}
+
+func (c *failingClient) Count(name string, value int64, tags []string, rate float64) error {
+	return errors.New("count failed")
+}
+
+func TestReporter_FlushWithOnFlush(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredCounter("counter", r).Inc(1)
+	metrics.NewRegisteredGauge("gauge", r).Update(1)
+	metrics.NewRegisteredGaugeFloat64("gauge-float", r).Update(1)
+	metrics.NewRegisteredHistogram("histogram", r, metrics.NewUniformSample(4)).Update(1)
+	metrics.NewRegisteredMeter("meter", r).Mark(1)
+	metrics.NewRegisteredTimer("timer", r).Update(time.Millisecond)
+
+	var stats []FlushStats
+	dd, _ := New(WithClient(&failingClient{}), WithRegistry(r),
+		WithOnFlush(func(s FlushStats) { stats = append(stats, s) }))
+	assert.EqualError(t, dd.Flush(), "count failed")
+
+	assert.Len(t, stats, 1)
+	assert.Equal(t, map[string]int{
+		"counter":   1,
+		"gauge":     2,
+		"histogram": 1,
+		"meter":     1,
+		"timer":     1,
+	}, stats[0].Metrics)
+	assert.Equal(t, 29, stats[0].Emissions)
+	assert.Equal(t, 1, stats[0].Errors)
+	assert.True(t, stats[0].Duration >= 0)
+}
+
+func TestReporter_FlushWithErrorMode(t *testing.T) {
+	r := metrics.NewRegistry()
+	for _, name := range []string{"a", "b", "c"} {
+		metrics.NewRegisteredCounter(name, r).Inc(1)
+		metrics.NewRegisteredGauge(name+".gauge", r).Update(1)
+	}
+
+	for _, tt := range []struct {
+		mode   ErrorMode
+		errors int
+		counts int
+	}{
+		{BestEffort, 3, 3},
+		{FailFast, 1, 1},
+	} {
+		var buf bytes.Buffer
+		var stats FlushStats
+		dd, _ := New(WithClient(&failingClient{}), WithRegistry(r), WithFileSink(&buf),
+			WithErrorMode(tt.mode), WithOnFlush(func(s FlushStats) { stats = s }))
+		assert.EqualError(t, dd.Flush(), "count failed")
+
+		assert.Equal(t, tt.errors, stats.Errors)
+		assert.Equal(t, tt.counts, strings.Count(buf.String(), "|c\n"))
+		if tt.mode == BestEffort {
+			assert.Equal(t, 3, strings.Count(buf.String(), "|g\n"))
+		}
+	}
+}
+
+// panickingGauge is a gauge that panics when read
+type panickingGauge struct {
+	metrics.NilGauge
+}
+
+func (g panickingGauge) Snapshot() metrics.Gauge {
+	return g
+}
+
+func (panickingGauge) Value() int64 {
+	panic("broken gauge")
+}
+
+func TestReporter_FlushWithPanicRecovery(t *testing.T) {
+	r := newRegistryWithCounter("foo", 1)
+	r.Register("bar", panickingGauge{})
+
+	var logs bytes.Buffer
+	dd, buf := newTestReporter(t, r, WithLogger(log.New(&logs, "", 0)), WithDroppedCounter(true))
+	assert.NoError(t, dd.Flush())
+
+	assert.Contains(t, buf.String(), "foo:1|c\n")
+	assert.Contains(t, buf.String(), "datadog_reporter.dropped:1|c|#reason:panic\n")
+	assert.Equal(t, "datadog: reporting bar panicked: broken gauge\n", logs.String())
+
+	// A panic outside of a metric ends the flush with an error
+	dd, _ = New(WithClient(&statsd.NoOpClient{}), WithRegistry(r), WithLogger(log.New(&logs, "", 0)),
+		WithOnFlush(func(FlushStats) { panic("broken hook") }))
+	assert.EqualError(t, dd.Flush(), "datadog: flush panicked: broken hook")
+
+	dd, _ = New(WithClient(&statsd.NoOpClient{}), WithRegistry(r), WithPanicRecovery(false))
+	assert.PanicsWithValue(t, "broken gauge", func() { dd.Flush() })
+}
+
+// eventClient is a statsd client recording the events it is sent
+type eventClient struct {
+	statsd.NoOpClient
+	events []statsd.Event
+}
+
+func (c *eventClient) Event(e *statsd.Event) error {
+	c.events = append(c.events, *e)
+	return nil
+}
+
+func TestReporter_EventWithTimestampSkew(t *testing.T) {
+	cn := &eventClient{}
+	dd, _ := New(WithClient(cn), WithTimestampSkew(2*time.Second))
+	dd.tags = []string{"env:test"}
+	dd.now = func() time.Time { return time.Unix(1000, 0) }
+
+	e := &statsd.Event{Title: "deploy", Text: "v1.2.3", Tags: []string{"service:api"}}
+	assert.NoError(t, dd.Event(e))
+	assert.NoError(t, dd.Event(&statsd.Event{Title: "restart", Timestamp: time.Unix(2000, 0)}))
+
+	if assert.Len(t, cn.events, 2) {
+		assert.Equal(t, time.Unix(1002, 0), cn.events[0].Timestamp)
+		assert.Equal(t, []string{"env:test", "service:api"}, cn.events[0].Tags)
+		assert.Equal(t, time.Unix(2002, 0), cn.events[1].Timestamp)
+	}
+
+	// The event itself is left unchanged
+	assert.True(t, e.Timestamp.IsZero())
+}
+
+// stalledClient is a statsd client whose buffer fails to drain while stalled
+type stalledClient struct {
+	statsd.NoOpClient
+	stalled bool
+}
+
+func (c *stalledClient) Flush() error {
+	if c.stalled {
+		return errors.New("flush failed")
+	}
+	return nil
+}
+
+func TestReporter_FlushWithBufferAgeMetric(t *testing.T) {
+	cn := &stalledClient{}
+
+	var buf bytes.Buffer
+	now := time.Unix(1000, 0)
+	dd, _ := New(WithClient(cn), WithRegistry(metrics.NewRegistry()), WithFileSink(&buf),
+		WithBufferAgeMetric(true))
+	dd.now = func() time.Time { return now }
+	dd.drained = now
+
+	for i, stalled := range []bool{false, false, true, true, false, false} {
+		cn.stalled = stalled
+		now = now.Add(10 * time.Second)
+		dd.Flush()
+		if i == 0 {
+			buf.Reset()
+		}
+	}
+
+	e := "datadog_reporter.buffer_age_seconds:10|g\n" +
+		"datadog_reporter.buffer_age_seconds:10|g\n" +
+		"datadog_reporter.buffer_age_seconds:20|g\n" +
+		"datadog_reporter.buffer_age_seconds:30|g\n" +
+		"datadog_reporter.buffer_age_seconds:10|g\n"
+	assert.Equal(t, e, buf.String())
+}
+
+func TestReporter_FlushWithConcurrentRegistration(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredCounter("foo", r).Inc(1)
+
+	dd, _ := New(WithClient(&statsd.NoOpClient{}), WithRegistry(r))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			name := fmt.Sprintf("bar-%d", i)
+			metrics.NewRegisteredTimer(name, r).Update(time.Millisecond)
+			if i%2 == 0 {
+				r.Unregister(name)
+			}
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, dd.Flush())
+	}
+	<-done
+	assert.NoError(t, dd.Flush())
+}
+
+func TestReporter_RecordTiming(t *testing.T) {
+	ch := newServer(t, 2)
+
+	dd, _ := New(WithAddress(addr), WithPrefix("app"))
+	dd.tags = []string{"env:test"}
+
+	assert.NoError(t, dd.RecordTiming("foo", 1500*time.Microsecond))
+	assert.NoError(t, dd.RecordTiming("foo", 2*time.Millisecond, "route:home"))
+	dd.Flush()
+
+	e := []string{
+		"app.foo:1.500000|ms|#env:test",
+		"app.foo:2.000000|ms|#env:test,route:home",
+	}
+	assert.Equal(t, e, receive(t, ch, 2))
+}
+
+func TestReporter_Set(t *testing.T) {
+	ch := newServer(t, 2)
+
+	dd, _ := New(WithAddress(addr), WithPrefix("app"))
+	dd.tags = []string{"env:test"}
+
+	assert.NoError(t, dd.Set("users", "alice"))
+	assert.NoError(t, dd.Set("users", "bob", "route:home"))
+	dd.Flush()
+
 	e := []string{
-		"foo.count:10.000000|g",
-		"foo.rate1:0.000000|g",
-		"foo.rate5:0.000000|g",
-		"foo.rate15:0.000000|g",
+		"app.users:alice|s|#env:test",
+		"app.users:bob|s|#env:test,route:home",
+	}
+	assert.Equal(t, e, receive(t, ch, 2))
+}
+
+func TestNew_WithAddressResolver(t *testing.T) {
+	addrs := []string{addr, ""}
+	resolve := func() (string, error) {
+		v := addrs[0]
+		addrs = addrs[1:]
+		if v == "" {
+			return "", errors.New("no agent")
+		}
+		return v, nil
+	}
+
+	var buf bytes.Buffer
+	r := newRegistryWithCounter("foo", 1)
+
+	dd, err := New(WithRegistry(r), WithAddressResolver(resolve))
+	assert.NoError(t, err)
+	assert.Equal(t, addr, dd.addr)
+
+	ch := newServer(t, 1)
+	dd.Flush()
+	assert.Equal(t, []string{"foo:1|c"}, receive(t, ch, 1))
+
+	// The address of WithAddress is kept when the resolver fails
+	dd, err = New(WithRegistry(r), WithAddress("127.0.0.1:9998"), WithAddressResolver(resolve),
+		WithLogger(log.New(&buf, "", 0)))
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:9998", dd.addr)
+	assert.Contains(t, buf.String(), "unable to resolve agent address, keeping 127.0.0.1:9998; no agent")
+}
+
+// newRegistryWithCounter returns a registry holding a counter with value v
+func newRegistryWithCounter(name string, v int64) metrics.Registry {
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredCounter(name, r).Inc(v)
+	return r
+}
+
+// newTestReporter returns a reporter of the metrics of r, with a no-op client
+// and the options given, and the buffer to which it writes the metrics sent
+func newTestReporter(t *testing.T, r metrics.Registry, options ...configFn) (*Reporter, *bytes.Buffer) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	dd, err := New(append([]configFn{WithClient(&statsd.NoOpClient{}), WithRegistry(r), WithFileSink(&buf)}, options...)...)
+	if err != nil {
+		t.Fatalf("unable to create reporter; %s", err)
+	}
+	return dd, &buf
+}
+
+func TestReporter_FlushWithFlushCounter(t *testing.T) {
+	ch := newServer(t, 3)
+
+	dd, _ := New(WithAddress(addr), WithRegistry(metrics.NewRegistry()),
+		WithFlushCounter("datadog_reporter.flushes"))
+	for i := 0; i < 3; i++ {
+		dd.Flush()
+	}
+
+	e := []string{
+		"datadog_reporter.flushes:1|c",
+		"datadog_reporter.flushes:1|c",
+		"datadog_reporter.flushes:1|c",
+	}
+	assert.Equal(t, e, receive(t, ch, 3))
+}
+
+func TestReporter_FlushWithBuildInfo(t *testing.T) {
+	ch := newServer(t, 1)
+
+	dd, _ := New(WithAddress(addr), WithRegistry(metrics.NewRegistry()),
+		WithBuildInfo(map[string]string{"version": "1.2.3", "commit": "abc123", "go_version": "go1.16"}))
+	dd.tags = []string{"env:test"}
+	dd.Flush()
+
+	assert.Equal(t, []string{"build_info:1|g|#env:test,commit:abc123,go_version:go1.16,version:1.2.3"}, receive(t, ch, 1))
+}
+
+func TestReporter_FlushWithStartTimeMetric(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	clock := func(r *Reporter) { r.now = func() time.Time { return now } }
+
+	dd, buf := newTestReporter(t, metrics.NewRegistry(),
+		WithStartTimeMetric("datadog_reporter.start_time"), clock)
+
+	for i := 0; i < 2; i++ {
+		now = now.Add(time.Minute)
+		dd.Flush()
+	}
+
+	assert.Equal(t, "datadog_reporter.start_time:1600000000|g\ndatadog_reporter.start_time:1600000000|g\n", buf.String())
+}
+
+func TestReporter_FlushWithIntervalMetric(t *testing.T) {
+	flushes := make(chan struct{}, 10)
+	dd, buf := newTestReporter(t, metrics.NewRegistry(),
+		WithIntervalMetric("datadog_reporter.flush_interval_seconds"),
+		WithOnFlush(func(FlushStats) { flushes <- struct{}{} }))
+
+	// Nothing is known of the interval before FlushWithInterval
+	dd.Flush()
+	<-flushes
+	assert.Empty(t, buf.String())
+
+	go dd.FlushWithInterval(10 * time.Millisecond)
+	select {
+	case <-flushes:
+	case <-time.After(time.Second):
+		assert.Fail(t, "timeout")
+	}
+	assert.NoError(t, dd.Close())
+
+	assert.True(t, strings.HasPrefix(buf.String(), "datadog_reporter.flush_interval_seconds:0.01|g\n"))
+}
+
+func TestReporter_FlushWithGoroutineGauge(t *testing.T) {
+	dd, buf := newTestReporter(t, metrics.NewRegistry(),
+		WithGoroutineGauge("runtime.goroutines"), WithReporterName("main"), WithMaxTagValueLength(4),
+		func(r *Reporter) { r.numGoroutine = func() int { return 42 } })
+	defer dd.Close()
+	dd.tags = []string{"env:production"}
+	dd.Flush()
+
+	assert.Equal(t, "runtime.goroutines:42|g|#env:prod,reporter:main\n", buf.String())
+
+	// The actual count is sent by default
+	buf.Reset()
+	dd.numGoroutine = runtime.NumGoroutine
+	dd.Flush()
+
+	var n int
+	_, err := fmt.Sscanf(buf.String(), "runtime.goroutines:%d|g", &n)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, n, 2)
+}
+
+// telemetryClient is a statsd client with fixed telemetry
+type telemetryClient struct {
+	statsd.NoOpClient
+}
+
+func (c *telemetryClient) FlushTelemetryMetrics() statsd.ClientMetrics {
+	return statsd.ClientMetrics{TotalMetrics: 12, TotalEvents: 2, TotalServiceChecks: 1, TotalDroppedOnReceive: 3}
+}
+
+func TestReporter_FlushWithClientTelemetry(t *testing.T) {
+	var buf bytes.Buffer
+	dd, _ := New(WithClient(&telemetryClient{}), WithRegistry(metrics.NewRegistry()), WithFileSink(&buf),
+		WithClientTelemetry(true))
+	dd.Flush()
+
+	e := "datadog_reporter.client.metrics:12|c\n" +
+		"datadog_reporter.client.events:2|c\n" +
+		"datadog_reporter.client.service_checks:1|c\n" +
+		"datadog_reporter.client.dropped_on_receive:3|c\n"
+	assert.Equal(t, e, buf.String())
+
+	// Clients without telemetry report nothing
+	buf.Reset()
+	dd, _ = New(WithClient(&statsd.NoOpClient{}), WithRegistry(metrics.NewRegistry()), WithFileSink(&buf),
+		WithClientTelemetry(true))
+	dd.Flush()
+	assert.Empty(t, buf.String())
+}
+
+func TestReporter_FlushWithClientTelemetryDialed(t *testing.T) {
+	ch := newServer(t, 2)
+
+	dd, _ := New(WithAddress(addr), WithRegistry(newRegistryWithCounter("foo", 1)), WithClientTelemetry(true))
+	dd.Flush()
+
+	assert.Equal(t, []string{"foo:1|c", "datadog_reporter.client.metrics:1|c"}, receive(t, ch, 2))
+}
+
+func TestReporter_FlushWithMetricDescriptions(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("foo", r).Update(1)
+	metrics.NewRegisteredGauge("bar", r).Update(2)
+
+	dd, buf := newTestReporter(t, r, WithMetricDescriptions(map[string]string{"foo": "queue_depth"}))
+	dd.Flush()
+
+	assert.Contains(t, buf.String(), "foo:1|g|#desc:queue_depth\n")
+	assert.Contains(t, buf.String(), "bar:2|g\n")
+}
+
+func TestReporter_FlushWithShardTag(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("foo", r).Update(1)
+
+	dd, buf := newTestReporter(t, r, WithShardTag("shard", 8, nil))
+	dd.Flush()
+	assert.Equal(t, "foo:1|g|#shard:7\n", buf.String())
+
+	// The default hash is deterministic
+	for name, e := range map[string]int{"foo": 7, "bar": 2, "requests": 3} {
+		assert.Equal(t, e, dd.shard(name), name)
+	}
+
+	dd, _ = New(WithClient(&statsd.NoOpClient{}), WithShardTag("shard", 4, func(name string) int { return -len(name) }))
+	assert.Equal(t, 1, dd.shard("foo"))
+}
+
+func TestReporter_FlushWithShardTagNoShards(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("foo", r).Update(1)
+
+	var logs bytes.Buffer
+	dd, buf := newTestReporter(t, r,
+		WithLogger(log.New(&logs, "", 0)), WithDroppedCounter(true), WithShardTag("shard", 0, nil))
+	dd.Flush()
+
+	assert.Equal(t, "foo:1|g\n", buf.String())
+	assert.Contains(t, logs.String(), "ignoring shard tag shard over 0 shards")
+}
+
+func TestReporter_WithRandSource(t *testing.T) {
+	jitters := func() []time.Duration {
+		dd, _ := New(WithClient(&statsd.NoOpClient{}), WithRandSource(rand.NewSource(42)),
+			WithFlushJitter(time.Second))
+
+		var res []time.Duration
+		for i := 0; i < 5; i++ {
+			d := dd.jitter()
+			assert.True(t, d >= 0 && d < time.Second)
+			res = append(res, d)
+		}
+		return res
+	}
+
+	assert.Equal(t, jitters(), jitters())
+
+	dd, _ := New(WithClient(&statsd.NoOpClient{}), WithRandSource(rand.NewSource(42)))
+	assert.Equal(t, time.Duration(0), dd.jitter())
+}
+
+func TestReporter_FlushWithIntervalAndJitter(t *testing.T) {
+	flushes := make(chan struct{}, 10)
+	dd, _ := New(WithClient(&statsd.NoOpClient{}), WithRegistry(metrics.NewRegistry()),
+		WithFlushJitter(5*time.Millisecond), WithOnFlush(func(FlushStats) { flushes <- struct{}{} }))
+	go dd.FlushWithInterval(5 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-flushes:
+		case <-time.After(time.Second):
+			assert.Fail(t, "timeout")
+		}
+	}
+	assert.NoError(t, dd.Close())
+}
+
+func TestReporter_DueTypes(t *testing.T) {
+	dd, _ := New(WithClient(&statsd.NoOpClient{}), WithTypeIntervals(map[MetricOrigin]time.Duration{
+		OriginCounter:   time.Second,
+		OriginHistogram: 10 * time.Second,
+	}))
+
+	var counters, gauges, histograms int
+	for n := 1; n <= 20; n++ {
+		due := dd.dueTypes(n, time.Second, 5*time.Second)
+		if due["counter"] {
+			counters++
+		}
+		if due["gauge"] {
+			gauges++
+		}
+		if due["histogram"] {
+			histograms++
+		}
+	}
+	assert.Equal(t, []int{20, 4, 2}, []int{counters, gauges, histograms})
+
+	dd, _ = New(WithClient(&statsd.NoOpClient{}))
+	assert.Nil(t, dd.dueTypes(1, time.Second, time.Second))
+}
+
+func TestReporter_FlushWithTypeIntervalsRate(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredCounter("foo", r)
+	m := metrics.NewRegisteredMeter("bar", r)
+
+	now := time.Unix(1000, 0)
+	dd, buf := newTestReporter(t, r,
+		WithCounterMode(CounterRate), WithInstantaneousMeterRate(true),
+		WithTypeIntervals(map[MetricOrigin]time.Duration{
+			OriginCounter: 10 * time.Second,
+			OriginMeter:   5 * time.Second,
+		}))
+	dd.now = func() time.Time { return now }
+	dd.last = now
+
+	// Every second, the counter increases by 10 and the meter by 3. The
+	// counter is flushed every 10 ticks and the meter every 5, so their rates
+	// are their deltas over 10 and 5 seconds, not over a single tick.
+	for n := 1; n <= 10; n++ {
+		c.Inc(10)
+		m.Mark(3)
+		now = now.Add(time.Second)
+		buf.Reset()
+		assert.NoError(t, dd.flush(dd.dueTypes(n, time.Second, time.Second)))
+	}
+
+	assert.Contains(t, buf.String(), "foo:10|g\n")
+	assert.Contains(t, buf.String(), "bar.rate:3|g\n")
+}
+
+func TestReporter_WithInvalidTypeIntervals(t *testing.T) {
+	var logs bytes.Buffer
+	dd, _ := New(WithClient(&statsd.NoOpClient{}), WithLogger(log.New(&logs, "", 0)),
+		WithTypeIntervals(map[MetricOrigin]time.Duration{
+			"countr":        time.Second,
+			OriginGauge:     0,
+			OriginHistogram: 2 * time.Second,
+		}))
+
+	assert.Equal(t, map[string]time.Duration{"histogram": 2 * time.Second}, dd.typeIntervals)
+	assert.Contains(t, logs.String(), `ignoring flush interval of unknown metric type "countr"`)
+	assert.Contains(t, logs.String(), "ignoring flush interval 0s of gauge, as it isn't positive")
+
+	// The gauges are flushed at the interval of FlushWithInterval
+	due := dd.dueTypes(1, time.Second, time.Second)
+	assert.True(t, due["gauge"])
+	assert.False(t, due["histogram"])
+}
+
+func TestReporter_FlushWithIntervalAndTypeIntervals(t *testing.T) {
+	r := newRegistryWithCounter("foo", 1)
+	metrics.NewRegisteredHistogram("bar", r, metrics.NewUniformSample(4)).Update(1)
+
+	var mu sync.Mutex
+	var counters, histograms int
+	dd, _ := New(WithClient(&statsd.NoOpClient{}), WithRegistry(r),
+		WithTypeIntervals(map[MetricOrigin]time.Duration{OriginHistogram: 30 * time.Millisecond}),
+		WithOnFlush(func(s FlushStats) {
+			mu.Lock()
+			defer mu.Unlock()
+			counters += s.Metrics["counter"]
+			histograms += s.Metrics["histogram"]
+		}))
+	go dd.FlushWithInterval(10 * time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return histograms >= 2
+	}, time.Second, time.Millisecond)
+	assert.NoError(t, dd.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.GreaterOrEqual(t, counters, 3*histograms-2)
+}
+
+func TestReporter_String(t *testing.T) {
+	dd, _ := New(WithAddress("127.0.0.2:8125"), WithPrefix("app"), WithTypeTag(true))
+	assert.Equal(t, `datadog.Reporter(addr=127.0.0.2:8125 prefix="app." percentiles=5 tags=0 counters=delta type-tag)`, dd.String())
+
+	dd, _ = New(WithClient(&statsd.NoOpClient{}), WithCounterMode(CounterRate))
+	assert.Contains(t, dd.String(), "addr=client *statsd.NoOpClient")
+	assert.Contains(t, dd.String(), "counters=rate")
+}
+
+func TestReporter_WithReporterName(t *testing.T) {
+	ch := newServer(t, 1)
+
+	var buf bytes.Buffer
+	dd, _ := New(WithAddress(addr), WithRegistry(metrics.NewRegistry()),
+		WithReporterName("jobs"), WithFlushCounter("datadog_reporter.flushes"),
+		WithLogger(log.New(&buf, "", 0)))
+	dd.Flush()
+
+	assert.Equal(t, []string{"datadog_reporter.flushes:1|c|#reporter:jobs"}, receive(t, ch, 1))
+	assert.Contains(t, dd.String(), "(name=jobs addr="+addr)
+
+	dd.logf("oops")
+	assert.Equal(t, "datadog jobs: oops\n", buf.String())
+}
+
+func TestReporter_FlushWithNameRegex(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredCounter("http.requests", r).Inc(1)
+	metrics.NewRegisteredCounter("http.errors", r).Inc(2)
+	metrics.NewRegisteredCounter("db.queries", r).Inc(3)
+	metrics.NewRegisteredCounter("myhttp.requests", r).Inc(4)
+	re := regexp.MustCompile(`^http\.`)
+
+	dd, buf := newTestReporter(t, r, WithNameRegex(re, true))
+	dd.Flush()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.ElementsMatch(t, []string{"http.requests:1|c", "http.errors:2|c"}, lines)
+
+	dd, buf = newTestReporter(t, r,
+		WithNameRegex(re, false))
+	dd.Flush()
+
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.ElementsMatch(t, []string{"db.queries:3|c", "myhttp.requests:4|c"}, lines)
+}
+
+func TestReporter_FlushWithDroppedCounter(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredCounter("internal.requests", r).Inc(1)
+	metrics.NewRegisteredCounter("internal.errors", r).Inc(1)
+	metrics.NewRegisteredGaugeFloat64("ratio", r).Update(math.NaN())
+	metrics.NewRegisteredGaugeFloat64("load", r).Update(math.Inf(1))
+	metrics.NewRegisteredGauge("size", r).Update(3)
+
+	dd, buf := newTestReporter(t, r,
+		WithNameRegex(regexp.MustCompile(`^internal\.`), false), WithDroppedCounter(true))
+	dd.Flush()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, []string{
+		"size:3|g",
+		"datadog_reporter.dropped:2|c|#reason:filter",
+		"datadog_reporter.dropped:2|c|#reason:non_finite",
+	}, lines)
+}
+
+func TestReporter_InjectedClientNamespace(t *testing.T) {
+	cn, err := statsd.New(addr)
+	assert.NoError(t, err)
+	defer cn.Close()
+	cn.Namespace = "app."
+
+	_, err = New(WithClient(cn), WithPrefix("foo."), WithClientNamespaceUnmanaged(true))
+	assert.NoError(t, err)
+	assert.Equal(t, "app.", cn.Namespace)
+
+	_, err = New(WithClient(cn), WithPrefix("foo."))
+	assert.NoError(t, err)
+	assert.Equal(t, "foo.", cn.Namespace)
+}
+
+func TestReporter_FlushWithClientNamespaceUnmanaged(t *testing.T) {
+	ch := newServer(t, 1)
+
+	cn, err := statsd.New(addr, statsd.WithMaxMessagesPerPayload(1))
+	assert.NoError(t, err)
+	defer cn.Close()
+	cn.Namespace = "app."
+
+	// The file sink writes what is sent, with the namespace of the client
+	var buf bytes.Buffer
+	dd, err := New(WithClient(cn), WithRegistry(newRegistryWithCounter("requests", 1)),
+		WithPrefix("foo."), WithClientNamespaceUnmanaged(true), WithFileSink(&buf))
+	assert.NoError(t, err)
+	assert.NoError(t, dd.Flush())
+
+	assert.Equal(t, []string{"app.requests:1|c"}, receive(t, ch, 1))
+	assert.Equal(t, "app.requests:1|c\n", buf.String())
+}
+
+type closeClient struct {
+	statsd.NoOpClient
+	closed int
+}
+
+func (c *closeClient) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestReporter_CloseInjectedClient(t *testing.T) {
+	cn := &closeClient{}
+	dd, err := New(WithClient(cn), WithCloseClient(false))
+	assert.NoError(t, err)
+	assert.NoError(t, dd.Close())
+	assert.Equal(t, 0, cn.closed)
+
+	dd, err = New(WithClient(cn))
+	assert.NoError(t, err)
+	assert.NoError(t, dd.Close())
+	assert.Equal(t, 1, cn.closed)
+}
+
+func TestReporter_FlushWithSecondaryPrefix(t *testing.T) {
+	ch := newServer(t, 4)
+
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredCounter("foo", r)
+	var buf bytes.Buffer
+	dd, _ := New(WithAddress(addr), WithRegistry(r), WithPrefix("new"), WithSecondaryPrefix("old"),
+		WithCounterMode(CounterDeltaGauge), WithFileSink(&buf))
+
+	c.Inc(2)
+	dd.Flush()
+	c.Inc(3)
+	dd.Flush()
+
+	assert.Equal(t, []string{"new.foo:2|g", "old.foo:2|g", "new.foo:3|g", "old.foo:3|g"}, receive(t, ch, 4))
+	assert.Equal(t, "new.foo:2|g\nold.foo:2|g\nnew.foo:3|g\nold.foo:3|g\n", buf.String())
+}
+
+func TestReporter_FlushWithTimerOps(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredTimer("bar", r)
+	for i := 0; i < 3; i++ {
+		c.Update(time.Millisecond)
+	}
+
+	dd, buf := newTestReporter(t, r, WithPercentiles(nil), WithTimerOps(true))
+	dd.Flush()
+	assert.Contains(t, buf.String(), "bar.ops:3|c\n")
+
+	c.Update(time.Millisecond)
+	c.Update(time.Millisecond)
+	buf.Reset()
+	dd.Flush()
+	assert.Contains(t, buf.String(), "bar.ops:2|c\n")
+
+	buf.Reset()
+	dd.Flush()
+	assert.Contains(t, buf.String(), "bar.ops:0|c\n")
+}
+
+func TestReporter_FlushWithMaxTagValueLength(t *testing.T) {
+	r := newRegistryWithCounter("foo", 1)
+	metrics.NewRegisteredCounter("bar", r).Inc(1)
+
+	var logs bytes.Buffer
+	dd, buf := newTestReporter(t, r,
+		WithMaxTagValueLength(8), WithLogger(log.New(&logs, "", 0)),
+		WithMetricDescriptions(map[string]string{"bar": "requests_served"}))
+	dd.tags = []string{"env:production_eu", "short:ok"}
+	dd.Flush()
+
+	assert.Contains(t, buf.String(), "foo:1|c|#env:producti,short:ok\n")
+	assert.Contains(t, buf.String(), "bar:1|c|#env:producti,short:ok,desc:requests\n")
+	assert.Equal(t, []string{"env:production_eu", "short:ok"}, dd.tags)
+
+	dd.Flush()
+	assert.Equal(t, 2, strings.Count(logs.String(), "truncating tag value"))
+}
+
+func TestReporter_FlushWithMaxTagValueLengthUTF8(t *testing.T) {
+	dd, buf := newTestReporter(t, newRegistryWithCounter("foo", 1),
+		WithMaxTagValueLength(4), WithLogger(log.New(io.Discard, "", 0)))
+
+	// é takes 2 bytes, so 4 bytes would split the second one
+	dd.tags = []string{"city:aéé"}
+	dd.Flush()
+
+	assert.Equal(t, "foo:1|c|#city:aé\n", buf.String())
+	assert.True(t, utf8.ValidString(buf.String()))
+}
+
+func TestReporter_FlushWithObserved(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredCounter("foo", r)
+	c.Inc(1)
+	metrics.NewRegisteredCounter("bar", r)
+
+	dd, buf := newTestReporter(t, r,
+		WithSkipZeroCounters(true), WithObserved(func(name string) bool { return name == "foo" }))
+	dd.Flush()
+	assert.Equal(t, "foo.observed:1|g\nfoo:1|c\n", buf.String())
+
+	buf.Reset()
+	dd.Flush()
+	assert.Equal(t, "foo.observed:1|g\n", buf.String())
+}
+
+func TestReporter_FlushWithPreSendFilter(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredCounter("foo", r).Inc(2)
+	metrics.NewRegisteredCounter("bar", r).Inc(1)
+	metrics.NewRegisteredGauge("baz", r).Update(3)
+
+	dd, buf := newTestReporter(t, r,
+		WithPreSendFilter(func(e *Emission) bool {
+			switch e.Name {
+			case "foo":
+				e.Value *= 10
+				e.Tags[0] = "env:test"
+			case "baz":
+				e.Type = CountType
+			}
+			return e.Name != "bar"
+		}))
+	dd.tags = []string{"env:prod"}
+	dd.Flush()
+
+	assert.ElementsMatch(t, []string{"foo:20|c|#env:test", "baz:3|c|#env:prod", ""}, strings.Split(buf.String(), "\n"))
+	assert.Equal(t, []string{"env:prod"}, dd.tags)
+}
+
+func TestReporter_FlushWithHistogramSumTotal(t *testing.T) {
+	r := metrics.NewRegistry()
+	h := metrics.NewRegisteredHistogram("bytes", r, metrics.NewUniformSample(16))
+	h.Update(100)
+	h.Update(50)
+
+	dd, buf := newTestReporter(t, r,
+		WithPercentiles(nil), WithHistogramSumTotal(func(name string) bool { return name == "bytes" }))
+	dd.Flush()
+	assert.Contains(t, buf.String(), "bytes.sum_total:150|c\n")
+
+	h.Update(30)
+	buf.Reset()
+	dd.Flush()
+	assert.Contains(t, buf.String(), "bytes.sum_total:30|c\n")
+
+	// Nothing is reported when the histogram is cleared, and the increase is
+	// reported again from then on
+	h.Clear()
+	h.Update(20)
+	buf.Reset()
+	dd.Flush()
+	assert.NotContains(t, buf.String(), "bytes.sum_total")
+
+	h.Update(5)
+	buf.Reset()
+	dd.Flush()
+	assert.Contains(t, buf.String(), "bytes.sum_total:5|c\n")
+}
+
+func TestReporter_FlushWithHistogramSumTotalFullSample(t *testing.T) {
+	r := metrics.NewRegistry()
+	h := metrics.NewRegisteredHistogram("bytes", r, metrics.NewUniformSample(2))
+	h.Update(100)
+	h.Update(100)
+
+	dd, buf := newTestReporter(t, r,
+		WithPercentiles(nil), WithHistogramSumTotal(func(name string) bool { return name == "bytes" }))
+	dd.Flush()
+	assert.Contains(t, buf.String(), "bytes.sum_total:200|c\n")
+
+	// The full sample replaces a value of 100 with a smaller one, so its sum
+	// goes down and nothing is reported rather than the whole sum again
+	for i := 0; i < 1000 && h.Sum() == 200; i++ {
+		h.Update(1)
+	}
+	assert.Less(t, h.Sum(), int64(200))
+	buf.Reset()
+	dd.Flush()
+	assert.NotContains(t, buf.String(), "bytes.sum_total")
+
+	buf.Reset()
+	dd.Flush()
+	assert.Contains(t, buf.String(), "bytes.sum_total:0|c\n")
+}
+
+func TestReporter_FlushWithCardinalityMetric(t *testing.T) {
+	a, b, c := newRegistryWithCounter("requests", 1), newRegistryWithCounter("requests", 2), newRegistryWithCounter("requests", 3)
+	metrics.NewRegisteredGauge("workers", c).Update(4)
+
+	var buf bytes.Buffer
+	dd, _ := New(WithClient(&statsd.NoOpClient{}), WithRegistries(a, b, c), WithFileSink(&buf),
+		WithConflictPolicy(ConflictTag), WithCardinalityMetric(true))
+	dd.tags = []string{"env:prod"}
+
+	for i := 0; i < 2; i++ {
+		buf.Reset()
+		dd.Flush()
+		assert.Contains(t, buf.String(), "requests.series_count:3|g|#env:prod\nworkers.series_count:1|g|#env:prod\n")
 	}
-	assert.Equal(t, e, res[:4])
-	assert.Regexp(t, regexp.MustCompile(`^foo\.mean:\d+\.\d+\|g$`), res[4])
 }
@@ -0,0 +1,48 @@
+// Package datadogtest provides a reporter capturing the metrics it flushes,
+// for tests of code reporting metrics to Datadog
+package datadogtest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/DataDog/datadog-go/statsd"
+	datadog "github.com/ryverapp/go-metrics-datadog"
+)
+
+// NewReporter creates a reporter for tests, sending nothing and capturing the
+// DogStatsD line of every metric flushed, without the trailing newline, in the
+// returned slice. Options are applied after those of the test reporter, so
+// WithRegistry sets the registry to report, and WithRenderer how lines are
+// rendered. The reporter is closed when the test ends.
+func NewReporter(tb testing.TB, options ...func(*datadog.Reporter)) (*datadog.Reporter, *[]string) {
+	tb.Helper()
+
+	lines := &[]string{}
+	options = append([]func(*datadog.Reporter){
+		datadog.WithClient(&statsd.NoOpClient{}),
+		datadog.WithFileSink(lineSink{lines}),
+	}, options...)
+
+	r, err := datadog.New(func(r *datadog.Reporter) {
+		for _, fn := range options {
+			fn(r)
+		}
+	})
+	if err != nil {
+		tb.Fatalf("datadog: unable to create test reporter; %s", err)
+	}
+	tb.Cleanup(func() { r.Close() })
+
+	return r, lines
+}
+
+// lineSink is a file sink appending the lines written to a slice
+type lineSink struct {
+	lines *[]string
+}
+
+func (s lineSink) Write(p []byte) (int, error) {
+	*s.lines = append(*s.lines, strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
@@ -0,0 +1,31 @@
+package datadogtest
+
+import (
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	datadog "github.com/ryverapp/go-metrics-datadog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewReporter(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredCounter("foo", r).Inc(2)
+	h := metrics.NewRegisteredHistogram("bar", r, metrics.NewUniformSample(4))
+	h.Update(1)
+	h.Update(3)
+
+	dd, lines := NewReporter(t, datadog.WithRegistry(r), datadog.WithPercentiles([]float64{0.5}))
+	assert.NoError(t, dd.Flush())
+
+	assert.ElementsMatch(t, []string{
+		"foo:2|c",
+		"bar.count:2|g",
+		"bar.max:3|g",
+		"bar.mean:2|g",
+		"bar.min:1|g",
+		"bar.stddev:1|g",
+		"bar.var:1|g",
+		"bar.pct-50.00:2|g",
+	}, *lines)
+}
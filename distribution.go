@@ -0,0 +1,124 @@
+package datadog
+
+import (
+	"github.com/rcrowley/go-metrics"
+)
+
+// DistributionFidelity determines which values represent a histogram reported
+// as a distribution with WithHistogramDistributions
+type DistributionFidelity int
+
+const (
+	// FidelityQuantiles sends values at evenly spaced quantiles, one per new
+	// value up to the maximum given to WithHistogramDistributions
+	FidelityQuantiles DistributionFidelity = iota
+
+	// FidelityLow sends the minimum, mean and maximum
+	FidelityLow
+
+	// FidelityMedium sends the values at the reported percentiles
+	FidelityMedium
+
+	// FidelityHigh sends all values of the sample. Samples keep values
+	// across flushes, so values may be sent more than once.
+	FidelityHigh
+)
+
+// WithHistogramDistributions reports the histograms for which fn returns true
+// as distributions, in place of gauges of their statistics and percentiles.
+// go-metrics histograms only keep a sample of their values, so the values
+// recorded since the previous flush are approximated: the sample is divided
+// into as many equal quantile buckets as there are new values, up to max, and
+// the value at the middle of each bucket is sent once. Beyond max new values,
+// Datadog counts fewer values than were recorded, but the shape of the
+// distribution is preserved.
+func WithHistogramDistributions(fn func(name string) bool, max int) configFn {
+	return func(r *Reporter) {
+		r.histogramDist = fn
+		r.histogramDistValues = max
+	}
+}
+
+// WithDistributionFidelity sets which values represent histograms reported as
+// distributions with WithHistogramDistributions, trading packets for accuracy.
+// Defaults to FidelityQuantiles.
+func WithDistributionFidelity(v DistributionFidelity) configFn {
+	return func(r *Reporter) {
+		r.fidelity = v
+	}
+}
+
+// timerDistribution sends the values of a timer at its percentiles, or its
+// mean without percentiles, as a distribution. Nothing is sent when the timer
+// hasn't been updated since the previous flush.
+func (r *Reporter) timerDistribution(dist string, ms metrics.Timer, ps []float64, tags []string) {
+	key := r.stateKey(dist + "|d")
+	v := ms.Count()
+	l := r.ss[key]
+	r.ss[key] = v
+	if v == l {
+		return
+	}
+
+	if len(ps) == 0 || !r.enoughSamples(v) {
+		r.distribution(dist, r.millis(ms.Mean()), tags)
+		return
+	}
+
+	for _, p := range ms.Percentiles(ps) {
+		r.distribution(dist, r.millis(p), tags)
+	}
+}
+
+// histogramDistribution sends the values of a histogram updated since the
+// previous flush as a distribution, approximated by values of its sample at
+// evenly spaced quantiles
+func (r *Reporter) histogramDistribution(name string, ms metrics.Histogram, conv func(float64) float64, tags []string) {
+	key := r.stateKey(name + "|d")
+	v := ms.Count()
+	l := r.ss[key]
+	r.ss[key] = v
+
+	if v == l {
+		return
+	}
+
+	var values []float64
+	switch r.fidelity {
+	case FidelityLow:
+		values = []float64{float64(ms.Min()), ms.Mean(), float64(ms.Max())}
+	case FidelityMedium:
+		ps, _ := r.percentilesFor(name)
+		values = ms.Percentiles(ps)
+	case FidelityHigh:
+		for _, x := range ms.Sample().Values() {
+			values = append(values, float64(x))
+		}
+	default:
+		if qs := distributionPlan(v-l, r.histogramDistValues); len(qs) > 0 {
+			values = ms.Percentiles(qs)
+		}
+	}
+
+	for _, x := range values {
+		r.distribution(name, conv(x), tags)
+	}
+}
+
+// distributionPlan returns the quantiles at which to sample a histogram for n
+// new values, at most max of them: the midpoints of equal-width quantile
+// buckets, each standing for an equal share of the n values
+func distributionPlan(n int64, max int) []float64 {
+	if n > int64(max) {
+		n = int64(max)
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	qs := make([]float64, n)
+	for i := range qs {
+		qs[i] = (float64(i) + 0.5) / float64(n)
+	}
+	return qs
+}
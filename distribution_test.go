@@ -0,0 +1,95 @@
+package datadog
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReporter_FlushWithHistogramDistributions(t *testing.T) {
+	r := metrics.NewRegistry()
+	h := metrics.NewRegisteredHistogram("foo", r, metrics.NewUniformSample(100))
+	metrics.NewRegisteredHistogram("bar", r, metrics.NewUniformSample(100)).Update(1)
+	for i := int64(1); i <= 100; i++ {
+		h.Update(i)
+	}
+
+	dd, buf := newTestReporter(t, r,
+		WithHistogramDistributions(func(name string) bool { return name == "foo" }, 4))
+
+	// 100 new values are capped to 4, at the middle of each quarter
+	dd.Flush()
+	assert.Equal(t, 4, strings.Count(buf.String(), "|d\n"))
+	assert.Contains(t, buf.String(), "foo:12.625|d\nfoo:37.875|d\nfoo:63.125|d\nfoo:88.375|d\n")
+	assert.Contains(t, buf.String(), "bar.count:1|g\n")
+	assert.NotContains(t, buf.String(), "foo.count")
+
+	// 2 new values are sent as 2, and none without new values
+	for _, n := range []int{2, 0} {
+		for i := 0; i < n; i++ {
+			h.Update(50)
+		}
+		buf.Reset()
+		dd.Flush()
+		assert.Equal(t, n, strings.Count(buf.String(), "foo:"))
+	}
+}
+
+func TestReporter_FlushWithDistributionFidelity(t *testing.T) {
+	for _, tt := range []struct {
+		fidelity DistributionFidelity
+		e        int
+	}{
+		{FidelityQuantiles, 8},
+		{FidelityLow, 3},
+		{FidelityMedium, 5},
+		{FidelityHigh, 10},
+	} {
+		r := metrics.NewRegistry()
+		h := metrics.NewRegisteredHistogram("foo", r, metrics.NewUniformSample(100))
+		for i := int64(1); i <= 10; i++ {
+			h.Update(i)
+		}
+
+		dd, buf := newTestReporter(t, r,
+			WithHistogramDistributions(func(string) bool { return true }, 8),
+			WithDistributionFidelity(tt.fidelity))
+		dd.Flush()
+		assert.Equal(t, tt.e, strings.Count(buf.String(), "|d\n"), "fidelity %d", tt.fidelity)
+
+		// Nothing is sent without new values
+		buf.Reset()
+		dd.Flush()
+		assert.Empty(t, buf.String())
+	}
+}
+
+func TestDistributionPlan(t *testing.T) {
+	assert.Nil(t, distributionPlan(0, 10))
+	assert.Equal(t, []float64{0.5}, distributionPlan(1, 10))
+	assert.Equal(t, []float64{0.125, 0.375, 0.625, 0.875}, distributionPlan(4, 10))
+	assert.Len(t, distributionPlan(1000, 10), 10)
+}
+
+func TestReporter_FlushWithMinSamplesForTimerDistributions(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredTimer("foo", r)
+	c.Update(time.Millisecond)
+	c.Update(3 * time.Millisecond)
+
+	dd, buf := newTestReporter(t, r,
+		WithPercentiles([]float64{0.5, 0.99}), WithTimerMode(TimerDistribution),
+		WithMinSamplesForPercentiles(3))
+
+	// The mean is sent until there are enough samples for the percentiles
+	dd.Flush()
+	assert.Equal(t, "foo:2|d\n", buf.String())
+
+	c.Update(2 * time.Millisecond)
+	buf.Reset()
+	dd.Flush()
+	assert.Equal(t, "foo:2|d\nfoo:3|d\n", buf.String())
+}
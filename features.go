@@ -0,0 +1,49 @@
+package datadog
+
+// Features is a set of DogStatsD protocol features supported by the agent
+type Features uint
+
+const (
+	// FeatureTags is the support of tags
+	FeatureTags Features = 1 << iota
+
+	// FeatureDistributions is the support of distributions, which are sent as
+	// gauges without it
+	FeatureDistributions
+
+	// FeatureTimestamps is the support of event timestamps, which are left
+	// for the agent to set without it
+	FeatureTimestamps
+
+	// FeatureOriginDetection is the support of origin detection, the entity
+	// ID tag being left out without it
+	FeatureOriginDetection
+
+	// AllFeatures is the set of all features, the default
+	AllFeatures = FeatureTags | FeatureDistributions | FeatureTimestamps | FeatureOriginDetection
+)
+
+// Has returns whether f includes all the features of v
+func (f Features) Has(v Features) bool {
+	return f&v == v
+}
+
+// WithProtocolFeatures sets the DogStatsD protocol features supported by the
+// agent, such as AllFeatures &^ FeatureDistributions for an agent too old for
+// distributions. Metrics are sent without the features left out, rather than
+// as packets the agent would reject.
+func WithProtocolFeatures(v Features) configFn {
+	return func(r *Reporter) {
+		r.features = v
+	}
+}
+
+// degrade changes a metric about to be sent to use only the supported features
+func (r *Reporter) degrade(e *Emission) {
+	if !r.features.Has(FeatureTags) {
+		e.Tags = nil
+	}
+	if e.Type == DistributionType && !r.features.Has(FeatureDistributions) {
+		e.Type = GaugeType
+	}
+}
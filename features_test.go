@@ -0,0 +1,46 @@
+package datadog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReporter_FlushWithoutTagsFeature(t *testing.T) {
+	t.Setenv("DD_TAGS", "team:core")
+	ch := newServer(t, 2)
+
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredCounter("foo", r).Inc(1)
+	dd, _ := New(WithAddress(addr), WithRegistry(r), WithPrefix(""), WithTypeTag(true),
+		WithProtocolFeatures(AllFeatures&^FeatureTags))
+	dd.tags = []string{"env:prod"}
+	dd.Flush()
+	assert.NoError(t, dd.RecordTiming("bar", time.Millisecond, "route:/"))
+	dd.cn.Flush()
+
+	assert.Equal(t, []string{"foo:1|c", "bar:1.000000|ms"}, receive(t, ch, 2))
+}
+
+func TestReporter_FlushWithoutDistributionsFeature(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredTimer("bar", r).Update(2 * time.Millisecond)
+
+	dd, buf := newTestReporter(t, r,
+		WithPercentiles(nil), WithTimerMode(TimerDistribution),
+		WithProtocolFeatures(AllFeatures&^FeatureDistributions))
+	dd.Flush()
+
+	assert.Equal(t, "bar:2|g\n", buf.String())
+}
+
+func TestReporter_EventWithoutTimestampsFeature(t *testing.T) {
+	cn := &eventClient{}
+	dd, _ := New(WithClient(cn), WithProtocolFeatures(AllFeatures&^FeatureTimestamps))
+	assert.NoError(t, dd.Event(&statsd.Event{Title: "deploy", Timestamp: time.Unix(100, 0)}))
+
+	assert.True(t, cn.events[0].Timestamp.IsZero())
+}
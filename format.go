@@ -0,0 +1,64 @@
+package datadog
+
+import (
+	"strconv"
+)
+
+// MetricType is the DogStatsD type of a metric, as its type symbol
+type MetricType string
+
+const (
+	// GaugeType is the type of gauges
+	GaugeType MetricType = "g"
+
+	// CountType is the type of counts
+	CountType MetricType = "c"
+
+	// DistributionType is the type of distributions
+	DistributionType MetricType = "d"
+
+	// HistogramType is the type of histograms, aggregated by the agent
+	HistogramType MetricType = "h"
+
+	// EventType is the type of events sent about a metric, such as with
+	// WithHealthcheckEvents, only seen by WithPreSendFilter. Their value is
+	// always zero, and they are not written to the file sink.
+	EventType MetricType = "e"
+)
+
+// Emission is a metric about to be sent, without the prefix
+type Emission struct {
+	Name  string
+	Value float64
+	Type  MetricType
+	Tags  []string
+}
+
+// Renderer renders a metric as a line of the wire format of a statsd
+// compatible backend, including the trailing newline
+type Renderer func(name string, v float64, typ MetricType, tags []string) []byte
+
+// RenderDogStatsD renders a metric in the DogStatsD wire format, the default
+func RenderDogStatsD(name string, v float64, typ MetricType, tags []string) []byte {
+	return appendMetric(nil, name, v, typ, tags)
+}
+
+// appendMetric appends the DogStatsD wire format of a metric to b
+func appendMetric(b []byte, name string, v float64, typ MetricType, tags []string) []byte {
+	b = append(b, name...)
+	b = append(b, ':')
+	b = strconv.AppendFloat(b, v, 'f', -1, 64)
+	b = append(b, '|')
+	b = append(b, typ...)
+
+	for i, tag := range tags {
+		if i == 0 {
+			b = append(b, "|#"...)
+		} else {
+			b = append(b, ',')
+		}
+		b = append(b, tag...)
+	}
+
+	return append(b, '\n')
+}
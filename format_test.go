@@ -0,0 +1,27 @@
+package datadog
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderDogStatsD(t *testing.T) {
+	assert.Equal(t, "foo:1.5|g\n", string(RenderDogStatsD("foo", 1.5, GaugeType, nil)))
+	assert.Equal(t, "foo:2|c|#a:1,b:2\n", string(RenderDogStatsD("foo", 2, CountType, []string{"a:1", "b:2"})))
+}
+
+func TestReporter_FlushWithRenderer(t *testing.T) {
+	r := newRegistryWithCounter("foo", 2)
+
+	// Plain statsd, without tags
+	plain := func(name string, v float64, typ MetricType, tags []string) []byte {
+		return []byte(name + ":" + strconv.FormatFloat(v, 'f', -1, 64) + "|" + string(typ) + "\n")
+	}
+
+	dd, buf := newTestReporter(t, r, WithPrefix("app"), WithTypeTag(true), WithRenderer(plain))
+	dd.Flush()
+
+	assert.Equal(t, "app.foo:2|c\n", buf.String())
+}
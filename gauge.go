@@ -0,0 +1,208 @@
+package datadog
+
+import (
+	"math"
+	"time"
+)
+
+// WithGaugeKeepAlive skips gauges whose value is unchanged since they were
+// last sent, sending them again at least every d so their series don't age out
+// in Datadog
+func WithGaugeKeepAlive(d time.Duration) configFn {
+	return func(r *Reporter) {
+		r.keepAlive = d
+	}
+}
+
+// WithGaugePrecision rounds gauge values to the given number of decimal
+// places. Set to a negative number to disable rounding, which is the default:
+// gauges are then sent with the fewest digits representing them exactly, so
+// that small values such as 1e-7 aren't lost to a fixed number of decimals.
+func WithGaugePrecision(digits int) configFn {
+	return func(r *Reporter) {
+		r.gaugePrecision = digits
+	}
+}
+
+// WithWholeNumberGauges sends gauges that are whole numbers but for floating
+// point error, such as 2.9999999999999996, as integers. Whole numbers are
+// always sent without a fractional part, as 100 rather than 100.000000, and
+// genuine fractions keep their decimals.
+func WithWholeNumberGauges(v bool) configFn {
+	return func(r *Reporter) {
+		r.wholeGauges = v
+	}
+}
+
+// WithDurationGauges marks the gauges for which fn returns true as holding
+// durations in nanoseconds, such as a time.Duration. Their values are reported
+// in the given unit, such as time.Second, rounded to the timer precision. A
+// unit of zero reports them in milliseconds, like timers.
+func WithDurationGauges(fn func(name string) bool, unit time.Duration) configFn {
+	return func(r *Reporter) {
+		if unit <= 0 {
+			unit = time.Millisecond
+		}
+		r.durationGauges = fn
+		r.durationUnit = unit
+	}
+}
+
+// WithMonotonicGauges reports the gauges for which fn returns true like
+// counters, as counts of their increase since the previous flush, rounded to
+// an integer. This suits gauges that hold ever increasing totals. A decrease
+// is taken as a reset of the total.
+func WithMonotonicGauges(fn func(name string) bool) configFn {
+	return func(r *Reporter) {
+		r.monotonic = fn
+	}
+}
+
+// WithMonotonicCountGauges is like WithMonotonicGauges, for gauges of counters
+// wrapping around to zero on reaching maxValue, such as 1<<32 for the 32-bit
+// network counters of an OS. A decrease is taken as a wraparound, its increase
+// counted up to maxValue and then from zero. It can be used together with
+// WithMonotonicGauges, and takes precedence for the gauges matching both.
+func WithMonotonicCountGauges(fn func(name string) bool, maxValue float64) configFn {
+	return func(r *Reporter) {
+		r.monotonicCount = fn
+		r.monotonicMax = maxValue
+	}
+}
+
+// WithGaugeDelta reports, for the gauges for which fn returns true, their
+// change since the previous flush as name.delta, alongside their value. This
+// suits gauges of levels such as queue depths.
+func WithGaugeDelta(fn func(name string) bool) configFn {
+	return func(r *Reporter) {
+		r.gaugeDelta = fn
+	}
+}
+
+// WithZeroOnRemoval reports a final zero for gauges removed from the registry,
+// rather than leaving Datadog to show their last value until it ages out
+func WithZeroOnRemoval(v bool) configFn {
+	return func(r *Reporter) {
+		r.zeroOnRemoval = v
+	}
+}
+
+// sentGauge is the last value sent for a gauge, and when
+type sentGauge struct {
+	value float64
+	at    time.Time
+}
+
+// gaugeValue returns the value of a gauge to report, rounded to the gauge
+// precision, or converted to the unit of WithDurationGauges when it holds a
+// duration
+func (r *Reporter) gaugeValue(name string, v float64) float64 {
+	if r.durationGauges == nil || !r.durationGauges(name) {
+		v = roundTo(v, r.gaugePrecision)
+	} else {
+		v = r.round(v / float64(r.durationUnit))
+	}
+
+	// The error of floating point arithmetic is relative to the value
+	if w := math.Round(v); r.wholeGauges && math.Abs(v-w) <= wholeTolerance*math.Max(1, math.Abs(w)) {
+		v = w
+	}
+	return v
+}
+
+// wholeTolerance is the relative error below which WithWholeNumberGauges
+// takes a gauge for a whole number
+const wholeTolerance = 1e-9
+
+// reportGauge sends the value of a gauge metric, unless it is unchanged and
+// deduplicated
+func (r *Reporter) reportGauge(name string, v float64, tags []string) {
+	if r.gaugeDelta != nil && r.gaugeDelta(name) {
+		defer r.reportGaugeDelta(name, v, tags)
+	}
+
+	if r.monotonicCount != nil && r.monotonicCount(name) {
+		r.reportMonotonic(name, v, r.monotonicMax, tags)
+		return
+	}
+
+	if r.monotonic != nil && r.monotonic(name) {
+		r.reportMonotonic(name, v, 0, tags)
+		return
+	}
+
+	if r.keepAlive > 0 {
+		sent, ok := r.sent[r.stateKey(name)]
+		if ok && sent.value == v && r.last.Sub(sent.at) < r.keepAlive {
+			r.drop("dedup")
+			return
+		}
+
+		if r.sent == nil {
+			r.sent = make(map[string]sentGauge)
+		}
+		r.sent[r.stateKey(name)] = sentGauge{v, r.last}
+	}
+
+	r.gauge(name, v, tags)
+}
+
+// reportGaugeDelta sends the change of a gauge since the previous flush as
+// name.delta. Nothing is sent the first time the gauge is seen.
+func (r *Reporter) reportGaugeDelta(name string, v float64, tags []string) {
+	if r.lastGauges == nil {
+		r.lastGauges = make(map[string]float64)
+	}
+
+	key := r.stateKey(name)
+	l, ok := r.lastGauges[key]
+	r.lastGauges[key] = v
+	if ok {
+		r.gauge(name+".delta", v-l, tags)
+	}
+}
+
+// reportMonotonic sends the increase of a monotonic gauge since the previous
+// flush as a count. A decrease is taken as a wraparound at max when max is
+// positive, and as a reset otherwise, so the value itself is the increase.
+func (r *Reporter) reportMonotonic(name string, v, max float64, tags []string) {
+	l, ok := r.gs[r.stateKey(name)]
+	if ok && v < l && max > 0 {
+		l -= max
+	} else if !ok || v < l {
+		l = 0
+	}
+
+	if r.gs == nil {
+		r.gs = make(map[string]float64)
+	}
+	r.gs[r.stateKey(name)] = v
+
+	r.count(name, int64(math.Round(v-l)), tags)
+}
+
+// zeroRemovedGauges reports a zero for gauges that were reported by the
+// previous flush and are no longer registered, so their series visibly drop
+func (r *Reporter) zeroRemovedGauges(entries []entry) {
+	seen := make(map[gaugeSeries]bool)
+	for _, e := range entries {
+		if originOf(e.metric) == "gauge" {
+			seen[gaugeSeries{e.name, e.tag}] = true
+		}
+	}
+
+	// The zero is tagged like the gauge was, so that it lands on its series
+	for s := range r.gauges {
+		if !seen[s] {
+			r.source = s.tag
+			r.gauge(s.name, 0, r.tagsFor(s.name, "gauge"))
+		}
+	}
+	r.source = ""
+	r.gauges = seen
+}
+
+// gaugeSeries is the name of a gauge with the tag of its source
+type gaugeSeries struct {
+	name, tag string
+}
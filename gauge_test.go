@@ -0,0 +1,270 @@
+package datadog
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReporter_FlushGauge(t *testing.T) {
+	ch := newServer(t, 1)
+
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredGauge("foo", r)
+	c.Update(100)
+
+	dd, _ := New(WithAddress(addr), WithRegistry(r))
+	dd.Flush()
+	select {
+	case d := <-ch:
+		assert.Equal(t, "foo:100|g", string(d))
+
+	case <-time.After(testWaitTimeout):
+		assert.Fail(t, "timeout")
+	}
+}
+
+func TestReporter_FlushGaugeFloat64(t *testing.T) {
+	ch := newServer(t, 1)
+
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredGaugeFloat64("foo", r)
+	c.Update(55.55)
+
+	dd, _ := New(WithAddress(addr), WithRegistry(r))
+	dd.Flush()
+	select {
+	case d := <-ch:
+		assert.Equal(t, "foo:55.55|g", string(d))
+
+	case <-time.After(testWaitTimeout):
+		assert.Fail(t, "timeout")
+	}
+}
+
+func TestReporter_FlushGaugeFloat64Small(t *testing.T) {
+	ch := newServer(t, 1)
+
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredGaugeFloat64("foo", r).Update(1e-7)
+
+	// Gauges are formatted with the fewest digits representing them exactly,
+	// so small values aren't lost to a fixed number of decimals
+	var buf bytes.Buffer
+	dd, _ := New(WithAddress(addr), WithRegistry(r), WithFileSink(&buf))
+	dd.Flush()
+
+	assert.Equal(t, []string{"foo:0.0000001|g"}, receive(t, ch, 1))
+	assert.Equal(t, "foo:0.0000001|g\n", buf.String())
+}
+
+func TestReporter_FlushGaugeWithPrecision(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredGaugeFloat64("ratio", r).Update(0.123456)
+	metrics.NewRegisteredGaugeFloat64("tiny", r).Update(1e-7)
+
+	for _, tt := range []struct {
+		digits int
+		e      []string
+	}{
+		{-1, []string{"ratio:0.123456|g", "tiny:0.0000001|g"}},
+		{2, []string{"ratio:0.12|g", "tiny:0|g"}},
+		{7, []string{"ratio:0.123456|g", "tiny:0.0000001|g"}},
+	} {
+		dd, buf := newTestReporter(t, r, WithGaugePrecision(tt.digits))
+		dd.Flush()
+
+		assert.ElementsMatch(t, tt.e, strings.Fields(buf.String()))
+	}
+}
+
+func TestReporter_FlushGaugeWholeNumbers(t *testing.T) {
+	ch := newServer(t, 2)
+
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("foo", r).Update(100)
+	metrics.NewRegisteredGaugeFloat64("bar", r).Update(100.25)
+
+	// Integer gauges are sent without a fractional part, and fractions keep
+	// their decimals
+	var buf bytes.Buffer
+	dd, _ := New(WithAddress(addr), WithRegistry(r), WithFileSink(&buf))
+	dd.Flush()
+
+	assert.ElementsMatch(t, []string{"foo:100|g", "bar:100.25|g"}, receive(t, ch, 2))
+	assert.Contains(t, buf.String(), "foo:100|g\n")
+	assert.Contains(t, buf.String(), "bar:100.25|g\n")
+}
+
+func TestReporter_FlushGaugeWithWholeNumbers(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("foo", r).Update(100)
+	metrics.NewRegisteredGaugeFloat64("bar", r).Update(100.25)
+	// Computed at run time, with floating point error
+	tenth := 0.1
+	metrics.NewRegisteredGaugeFloat64("baz", r).Update(tenth * 3 * 10)
+
+	for _, tt := range []struct {
+		whole bool
+		e     []string
+	}{
+		{false, []string{"foo:100|g", "bar:100.25|g", "baz:3.0000000000000004|g"}},
+		{true, []string{"foo:100|g", "bar:100.25|g", "baz:3|g"}},
+	} {
+		dd, buf := newTestReporter(t, r, WithWholeNumberGauges(tt.whole))
+		dd.Flush()
+
+		assert.ElementsMatch(t, tt.e, strings.Fields(buf.String()))
+	}
+}
+
+func TestReporter_FlushWithDurationGauges(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("latency", r).Update(int64(1500 * time.Microsecond))
+	metrics.NewRegisteredGauge("queue", r).Update(1500)
+	metrics.NewRegisteredGaugeFloat64("uptime", r).Update(float64(90 * time.Second))
+
+	dd, buf := newTestReporter(t, r,
+		WithDurationGauges(func(name string) bool { return name == "latency" }, time.Millisecond))
+	dd.Flush()
+
+	assert.Contains(t, buf.String(), "latency:1.5|g\n")
+	assert.Contains(t, buf.String(), "queue:1500|g\n")
+	assert.Contains(t, buf.String(), "uptime:90000000000|g\n")
+
+	dd, buf = newTestReporter(t, r,
+		WithDurationGauges(func(name string) bool { return name == "uptime" }, time.Minute))
+	dd.Flush()
+
+	assert.Contains(t, buf.String(), "uptime:1.5|g\n")
+}
+
+func TestReporter_FlushGauge_KeepAlive(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredGauge("foo", r)
+	c.Update(1)
+
+	now := time.Unix(1000, 0)
+	dd, buf := newTestReporter(t, r, WithGaugeKeepAlive(10*time.Second))
+	dd.now = func() time.Time { return now }
+
+	for _, d := range []time.Duration{0, 5, 10, 12, 13} {
+		now = time.Unix(1000, 0).Add(d * time.Second)
+		if d == 13 {
+			c.Update(2)
+		}
+		dd.Flush()
+	}
+
+	assert.Equal(t, "foo:1|g\nfoo:1|g\nfoo:2|g\n", buf.String())
+}
+
+func TestReporter_FlushGauge_Monotonic(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredGauge("bytes", r)
+	metrics.NewRegisteredGauge("queue", r).Update(4)
+
+	dd, buf := newTestReporter(t, r,
+		WithNameRegex(regexp.MustCompile(`^bytes$`), true),
+		WithMonotonicGauges(func(name string) bool { return name == "bytes" }))
+
+	for _, v := range []int64{100, 150, 150, 400, 20} {
+		c.Update(v)
+		dd.Flush()
+	}
+
+	assert.Equal(t, "bytes:100|c\nbytes:50|c\nbytes:0|c\nbytes:250|c\nbytes:20|c\n", buf.String())
+}
+
+func TestReporter_FlushGauge_MonotonicCountWraparound(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredGauge("bytes", r)
+
+	dd, buf := newTestReporter(t, r,
+		WithMonotonicCountGauges(func(name string) bool { return name == "bytes" }, 1<<32))
+
+	for _, v := range []int64{1<<32 - 100, 1<<32 - 10, 40, 90} {
+		c.Update(v)
+		dd.Flush()
+	}
+
+	assert.Equal(t, "bytes:4294967196|c\nbytes:90|c\nbytes:50|c\nbytes:50|c\n", buf.String())
+}
+
+func TestReporter_FlushGauge_MonotonicAndMonotonicCount(t *testing.T) {
+	r := metrics.NewRegistry()
+	rx := metrics.NewRegisteredGauge("rx_bytes", r)
+	total := metrics.NewRegisteredGauge("total", r)
+
+	dd, buf := newTestReporter(t, r,
+		WithMonotonicGauges(func(name string) bool { return name == "total" }),
+		WithMonotonicCountGauges(func(name string) bool { return name == "rx_bytes" }, 1<<32))
+
+	// rx_bytes wraps around while total is reset
+	for _, v := range [][2]int64{{1<<32 - 10, 100}, {30, 40}} {
+		rx.Update(v[0])
+		total.Update(v[1])
+		buf.Reset()
+		dd.Flush()
+	}
+
+	assert.Contains(t, buf.String(), "rx_bytes:40|c\n")
+	assert.Contains(t, buf.String(), "total:40|c\n")
+}
+
+func TestReporter_FlushWithGaugeDelta(t *testing.T) {
+	r := metrics.NewRegistry()
+	g := metrics.NewRegisteredGauge("queue", r)
+
+	dd, buf := newTestReporter(t, r, WithGaugeDelta(func(name string) bool { return name == "queue" }))
+
+	for _, v := range []int64{3, 7, 12, 10} {
+		g.Update(v)
+		dd.Flush()
+	}
+
+	e := "queue:3|g\n" +
+		"queue:7|g\nqueue.delta:4|g\n" +
+		"queue:12|g\nqueue.delta:5|g\n" +
+		"queue:10|g\nqueue.delta:-2|g\n"
+	assert.Equal(t, e, buf.String())
+}
+
+func TestReporter_FlushGauge_ZeroOnRemoval(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("foo", r).Update(100)
+
+	dd, buf := newTestReporter(t, r, WithZeroOnRemoval(true))
+	dd.Flush()
+	r.Unregister("foo")
+	dd.Flush()
+	dd.Flush()
+
+	assert.Equal(t, "foo:100|g\nfoo:0|g\n", buf.String())
+}
+
+func TestReporter_FlushGauge_ZeroOnRemovalTagged(t *testing.T) {
+	a, b := metrics.NewRegistry(), metrics.NewRegistry()
+	metrics.NewRegisteredGauge("foo", a).Update(100)
+	metrics.NewRegisteredGauge("foo", b).Update(200)
+
+	var buf bytes.Buffer
+	dd, _ := New(WithClient(&statsd.NoOpClient{}), WithRegistries(a, b), WithFileSink(&buf),
+		WithConflictPolicy(ConflictTag), WithZeroOnRemoval(true))
+	dd.Flush()
+	b.Unregister("foo")
+	buf.Reset()
+	dd.Flush()
+
+	// The gauge of the first registry is no longer tagged without a conflict,
+	// so both tagged series are zeroed
+	assert.Contains(t, buf.String(), "foo:0|g|#registry:0\n")
+	assert.Contains(t, buf.String(), "foo:0|g|#registry:1\n")
+	assert.NotContains(t, buf.String(), "foo:0|g\n")
+}
@@ -0,0 +1,54 @@
+package datadog
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/rcrowley/go-metrics"
+)
+
+// WithHealthcheckEvents sends an event whenever a healthcheck of the registry
+// starts failing, with its error as the text, and when it recovers. The
+// healthchecks are not run by the reporter, and are taken to be healthy until
+// first seen failing.
+func WithHealthcheckEvents(v bool) configFn {
+	return func(r *Reporter) {
+		r.healthcheckEvents = v
+	}
+}
+
+// reportHealthchecks sends an event for each healthcheck whose state changed
+// since the previous flush
+func (r *Reporter) reportHealthchecks() {
+	if r.failing == nil {
+		r.failing = make(map[string]bool)
+	}
+
+	for n, registry := range r.allRegistries() {
+		var names []string
+		checks := make(map[string]metrics.Healthcheck)
+		registry.Each(func(name string, i interface{}) {
+			if h, ok := i.(metrics.Healthcheck); ok && !r.excluded(name) {
+				names = append(names, name)
+				checks[name] = h
+			}
+		})
+		sort.Strings(names)
+
+		for _, name := range names {
+			err := checks[name].Error()
+			key := fmt.Sprintf("%d|%s", n, name)
+			if failing := err != nil; failing == r.failing[key] {
+				continue
+			}
+			r.failing[key] = err != nil
+
+			if err != nil {
+				r.emitEvent(name, " is failing", &statsd.Event{Text: err.Error(), AlertType: statsd.Error})
+			} else {
+				r.emitEvent(name, " recovered", &statsd.Event{AlertType: statsd.Success})
+			}
+		}
+	}
+}
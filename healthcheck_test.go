@@ -0,0 +1,89 @@
+package datadog
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReporter_FlushWithHealthcheckEvents(t *testing.T) {
+	r := metrics.NewRegistry()
+	h := metrics.NewHealthcheck(func(metrics.Healthcheck) {})
+	r.Register("db", h)
+
+	cn := &eventClient{}
+	dd, _ := New(WithClient(cn), WithRegistry(r), WithPrefix("app"), WithHealthcheckEvents(true))
+
+	// Healthy at first, then failing for two flushes, then healthy again
+	dd.Flush()
+	h.Unhealthy(errors.New("connection refused"))
+	dd.Flush()
+	dd.Flush()
+	h.Healthy()
+	dd.Flush()
+	dd.Flush()
+
+	if assert.Len(t, cn.events, 2) {
+		assert.Equal(t, "app.db is failing", cn.events[0].Title)
+		assert.Equal(t, "connection refused", cn.events[0].Text)
+		assert.Equal(t, statsd.Error, cn.events[0].AlertType)
+		assert.Equal(t, "app.db recovered", cn.events[1].Title)
+		assert.Equal(t, statsd.Success, cn.events[1].AlertType)
+	}
+}
+
+func TestReporter_FlushWithHealthcheckEventsSubmitted(t *testing.T) {
+	r := metrics.NewRegistry()
+	r.Register("db", metrics.NewHealthcheck(func(h metrics.Healthcheck) {}))
+	r.Register("cache", metrics.NewHealthcheck(func(h metrics.Healthcheck) {}))
+	for _, name := range []string{"db", "cache"} {
+		r.Get(name).(metrics.Healthcheck).Unhealthy(errors.New("down"))
+	}
+
+	// Events are sent with both prefixes, and pass through the pre-send filter
+	// like metrics
+	var seen []Emission
+	cn := &eventClient{}
+	dd, _ := New(WithClient(cn), WithRegistry(r), WithPrefix("app"), WithSecondaryPrefix("legacy"),
+		WithHealthcheckEvents(true), WithPreSendFilter(func(e *Emission) bool {
+			seen = append(seen, *e)
+			e.Tags = append(e.Tags, "checked:true")
+			return e.Name != "cache"
+		}))
+	dd.Flush()
+
+	assert.Equal(t, []Emission{{"cache", 0, EventType, nil}, {"db", 0, EventType, nil}}, seen)
+	if assert.Len(t, cn.events, 2) {
+		assert.Equal(t, "app.db is failing", cn.events[0].Title)
+		assert.Equal(t, "legacy.db is failing", cn.events[1].Title)
+		assert.Equal(t, []string{"checked:true"}, cn.events[1].Tags)
+	}
+}
+
+func TestReporter_FlushWithHealthcheckEventsFailFast(t *testing.T) {
+	r := newRegistryWithCounter("foo", 1)
+	h := metrics.NewHealthcheck(func(metrics.Healthcheck) {})
+	h.Unhealthy(errors.New("down"))
+	r.Register("db", h)
+
+	// The failed count stops the flush before the event
+	cn := &failingEventClient{}
+	dd, _ := New(WithClient(cn), WithRegistry(r), WithErrorMode(FailFast),
+		WithHealthcheckEvents(true))
+
+	assert.EqualError(t, dd.Flush(), "count failed")
+	assert.Empty(t, cn.events)
+}
+
+// failingEventClient is a statsd client recording the events it is sent, whose
+// counts fail
+type failingEventClient struct {
+	eventClient
+}
+
+func (c *failingEventClient) Count(name string, value int64, tags []string, rate float64) error {
+	return errors.New("count failed")
+}
@@ -0,0 +1,96 @@
+package datadog
+
+import (
+	"fmt"
+	"math"
+)
+
+// DDType is a DogStatsD type with which a metric can be reported
+type DDType int
+
+const (
+	// DDGauge reports the value as a gauge
+	DDGauge DDType = iota
+
+	// DDCount reports the value as a count, rounded to an integer
+	DDCount
+
+	// DDRate reports the value per second since the previous flush as a
+	// gauge
+	DDRate
+
+	// DDDistribution reports the value as a distribution, aggregated by
+	// Datadog
+	DDDistribution
+
+	// DDHistogram reports the value as a histogram, aggregated by the agent
+	DDHistogram
+)
+
+func (t DDType) String() string {
+	switch t {
+	case DDGauge:
+		return "gauge"
+	case DDCount:
+		return "count"
+	case DDRate:
+		return "rate"
+	case DDDistribution:
+		return "distribution"
+	case DDHistogram:
+		return "histogram"
+	}
+
+	return fmt.Sprintf("DDType(%d)", int(t))
+}
+
+// validKind returns whether a metric of the given go-metrics type can be
+// reported with type t
+func validKind(origin string, t DDType) bool {
+	switch origin {
+	case "counter":
+		return t >= DDGauge && t <= DDHistogram
+	case "gauge":
+		return t == DDGauge || t == DDCount
+	}
+
+	return false
+}
+
+// reportKind sends v, the value of the named metric, with the type set with
+// WithMetricKinds. It returns false when no valid type is set, for the metric
+// to be reported as usual.
+func (r *Reporter) reportKind(name, origin string, v, elapsed float64, tags []string) bool {
+	t, ok := r.kinds[name]
+	if !ok {
+		return false
+	}
+
+	if !validKind(origin, t) {
+		if !r.invalidKinds[name] {
+			r.logf("%s %s can't be reported as a %s, ignoring", origin, name, t)
+			if r.invalidKinds == nil {
+				r.invalidKinds = make(map[string]bool)
+			}
+			r.invalidKinds[name] = true
+		}
+		return false
+	}
+
+	switch t {
+	case DDGauge:
+		r.gauge(name, v, tags)
+	case DDCount:
+		r.count(name, int64(math.Round(v)), tags)
+	case DDRate:
+		if elapsed > 0 {
+			r.gauge(name, v/elapsed, tags)
+		}
+	case DDDistribution:
+		r.distribution(name, v, tags)
+	case DDHistogram:
+		r.histogram(name, v, tags)
+	}
+
+	return true
+}
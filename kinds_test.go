@@ -0,0 +1,60 @@
+package datadog
+
+import (
+	"bytes"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReporter_FlushWithMetricKinds(t *testing.T) {
+	ch := newServer(t, 1)
+
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("foo", r).Update(5)
+
+	dd, _ := New(WithAddress(addr), WithRegistry(r), WithMetricKinds(map[string]DDType{"foo": DDCount}))
+	dd.Flush()
+
+	assert.Equal(t, []string{"foo:5|c"}, receive(t, ch, 1))
+}
+
+func TestReporter_FlushWithMetricKindsCounter(t *testing.T) {
+	for _, tt := range []struct {
+		kind DDType
+		e    string
+	}{
+		{DDGauge, "foo:10|g\n"},
+		{DDCount, "foo:10|c\n"},
+		{DDRate, "foo:5|g\n"},
+		{DDDistribution, "foo:10|d\n"},
+		{DDHistogram, "foo:10|h\n"},
+	} {
+		now := time.Unix(1000, 0)
+		dd, buf := newTestReporter(t, newRegistryWithCounter("foo", 10),
+			WithMetricKinds(map[string]DDType{"foo": tt.kind}))
+		dd.now = func() time.Time { return now }
+		dd.last = now
+
+		now = now.Add(2 * time.Second)
+		dd.Flush()
+		assert.Equal(t, tt.e, buf.String(), tt.kind.String())
+	}
+}
+
+func TestReporter_FlushWithInvalidMetricKind(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("foo", r).Update(5)
+
+	var logs bytes.Buffer
+	dd, buf := newTestReporter(t, r,
+		WithLogger(log.New(&logs, "", 0)), WithMetricKinds(map[string]DDType{"foo": DDDistribution}))
+	dd.Flush()
+	dd.Flush()
+
+	assert.Equal(t, "foo:5|g\nfoo:5|g\n", buf.String())
+	assert.Equal(t, "datadog: gauge foo can't be reported as a distribution, ignoring\n", logs.String())
+}
@@ -0,0 +1,65 @@
+package datadog
+
+import (
+	"github.com/rcrowley/go-metrics"
+)
+
+// WithMeterDelta reports the count of meters as the number of marks since the
+// previous flush, sent as a count, rather than as a cumulative gauge
+func WithMeterDelta(v bool) configFn {
+	return func(r *Reporter) {
+		r.meterDelta = v
+	}
+}
+
+// WithInstantaneousMeterRate reports meters as their count and the per-second
+// rate observed since the previous flush, in place of the EWMA rates. This
+// gives a truthful rate when flushing more often than the EWMA windows. No
+// rate is reported the first time a meter is flushed, as there is no previous
+// count to compare with.
+func WithInstantaneousMeterRate(v bool) configFn {
+	return func(r *Reporter) {
+		r.instantRate = v
+	}
+}
+
+// WithMeterPacking sends the values of meters packed together in as few
+// datagrams as fit them, through a client of their own flushed once all the
+// meters are reported, rather than one datagram per value when FlushLength is
+// 1. It has no effect on a client set with WithClient.
+func WithMeterPacking(v bool) configFn {
+	return func(r *Reporter) {
+		r.meterPacking = v
+	}
+}
+
+// reportMeter sends the values of a meter, through the client of the meters
+// with WithMeterPacking
+func (r *Reporter) reportMeter(name string, ms metrics.Meter, elapsed float64, tags []string) {
+	if r.meters != nil {
+		r.batch = r.meters
+		defer func() { r.batch = nil }()
+	}
+
+	v := ms.Count()
+	l, seen := r.ss[r.stateKey(name)]
+	r.ss[r.stateKey(name)] = v
+
+	if r.meterDelta {
+		r.count(name+".count", v-l, tags)
+	} else {
+		r.gauge(name+".count", float64(v), tags)
+	}
+
+	if r.instantRate {
+		if seen && elapsed > 0 {
+			r.gauge(name+".rate", float64(v-l)/elapsed, tags)
+		}
+		return
+	}
+
+	r.gauge(name+".rate1", ms.Rate1(), tags)
+	r.gauge(name+".rate5", ms.Rate5(), tags)
+	r.gauge(name+".rate15", ms.Rate15(), tags)
+	r.gauge(name+".mean", ms.RateMean(), tags)
+}
@@ -0,0 +1,136 @@
+package datadog
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReporter_FlushMeter(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredMeter("foo", r)
+
+	for i := 0; i < 10; i++ {
+		c.Mark(1)
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	n := 5
+	ch := newServer(t, n)
+
+	dd, _ := New(WithAddress(addr), WithRegistry(r))
+	dd.Flush()
+
+	var res []string
+	for i := 0; i < n; i++ {
+		select {
+		case d := <-ch:
+			res = append(res, string(d))
+
+		case <-time.After(testWaitTimeout):
+			assert.FailNow(t, "timeout")
+		}
+	}
+
+	e := []string{
+		"foo.count:10|g",
+		"foo.rate1:0|g",
+		"foo.rate5:0|g",
+		"foo.rate15:0|g",
+	}
+	assert.Equal(t, e, res[:4])
+	assert.Regexp(t, regexp.MustCompile(`^foo\.mean:\d+(\.\d+)?\|g$`), res[4])
+}
+
+func TestReporter_FlushMeter_Delta(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredMeter("foo", r)
+
+	dd, buf := newTestReporter(t, r, WithMeterDelta(true), WithInstantaneousMeterRate(true))
+
+	c.Mark(10)
+	dd.Flush()
+	c.Mark(4)
+	dd.Flush()
+
+	lines := strings.Split(buf.String(), "\n")
+	assert.Equal(t, "foo.count:10|c", lines[0])
+	assert.Equal(t, "foo.count:4|c", lines[1])
+}
+
+func TestReporter_FlushMeter_InstantaneousRate(t *testing.T) {
+	ch := newServer(t, 5)
+
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredMeter("foo", r)
+
+	now := time.Unix(1000, 0)
+	dd, _ := New(WithAddress(addr), WithRegistry(r), WithInstantaneousMeterRate(true))
+	dd.now = func() time.Time { return now }
+	dd.last = now
+
+	// The first flush has no previous count to compute a rate from
+	c.Mark(10)
+	now = now.Add(2 * time.Second)
+	dd.Flush()
+
+	c.Mark(5)
+	now = now.Add(500 * time.Millisecond)
+	dd.Flush()
+
+	c.Mark(20)
+	now = now.Add(4 * time.Second)
+	dd.Flush()
+
+	e := []string{
+		"foo.count:10|g",
+		"foo.count:15|g",
+		"foo.rate:10|g",
+		"foo.count:35|g",
+		"foo.rate:5|g",
+	}
+	assert.Equal(t, e, receive(t, ch, 5))
+}
+
+func TestReporter_FlushWithMeterPacking(t *testing.T) {
+	ch := newServer(t, 2)
+
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredMeter("foo", r).Mark(1)
+	metrics.NewRegisteredMeter("baz", r).Mark(2)
+	metrics.NewRegisteredCounter("bar", r).Inc(1)
+	dd, _ := New(WithAddress(addr), WithRegistry(r), WithPrefix(""), WithMeterPacking(true))
+	defer dd.Close()
+	dd.Flush()
+
+	// The counter is sent on its own, and the meters together in a single
+	// datagram
+	var meters []string
+	for _, v := range receive(t, ch, 2) {
+		if v != "bar:1|c" {
+			meters = strings.Split(v, "\n")
+		}
+	}
+
+	if assert.Len(t, meters, 10) {
+		for _, name := range []string{"foo", "baz"} {
+			var values []string
+			for _, v := range meters {
+				if strings.HasPrefix(v, name+".") {
+					values = append(values, v)
+				}
+			}
+			if assert.Len(t, values, 5, name) {
+				assert.True(t, strings.HasPrefix(values[0], name+".count:"))
+				assert.Equal(t, name+".rate1:0|g", values[1])
+				assert.Equal(t, name+".rate5:0|g", values[2])
+				assert.Equal(t, name+".rate15:0|g", values[3])
+				assert.True(t, strings.HasPrefix(values[4], name+".mean:"))
+			}
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package datadog
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// PercentileBand is a range between two percentiles
+type PercentileBand struct {
+	Lo, Hi float64
+}
+
+// suffix returns the metric name suffix of the band, such as .band_p50_p99_9
+// for the band from 0.5 to 0.999
+func (b PercentileBand) suffix() string {
+	return ".band_p" + percentName(b.Lo) + "_p" + percentName(b.Hi)
+}
+
+// WithPercentiles sets the percentiles to use for statistical metrics.
+// The default percentiles are 75%, 95%, 99% and 99.9%
+//
+// The percentiles 0 and 1 report the minimum and maximum, as .pct-0.00 and
+// .pct-100.00 unless named with WithPercentileNames.
+//
+// Set to nil to disable percentiles.
+func WithPercentiles(v []float64) configFn {
+	return func(r *Reporter) {
+		r.percentiles = v
+	}
+}
+
+// WithMetricPercentiles sets a function returning the percentiles of a
+// histogram or timer by name, overriding those set with WithPercentiles. When
+// the function returns nil, the default percentiles are used.
+func WithMetricPercentiles(fn func(name string) []float64) configFn {
+	return func(r *Reporter) {
+		r.metricPercentiles = fn
+	}
+}
+
+// WithPercentileNames sets the suffixes of specific percentiles, such as
+// ".median" for 0.5. Percentiles not in v keep the default ".pct-NN.NN"
+// suffix.
+func WithPercentileNames(v map[float64]string) configFn {
+	return func(r *Reporter) {
+		r.percentileNames = v
+	}
+}
+
+// WithPercentileBands reports the spread between pairs of percentiles of
+// histograms and timers, such as name.band_p50_p90 for the difference between
+// the 90th and 50th percentiles
+func WithPercentileBands(v []PercentileBand) configFn {
+	return func(r *Reporter) {
+		r.bands = v
+	}
+}
+
+// WithMinSamplesForPercentiles reports the percentiles of histograms and
+// timers, the bands and interquartile ranges derived from them, and the median
+// absolute deviations of histograms only once their count reaches n.
+// Percentiles of a handful of values are misleading. Until then, timers
+// reported as distributions send their mean, as without percentiles.
+func WithMinSamplesForPercentiles(n int) configFn {
+	return func(r *Reporter) {
+		r.minSamples = n
+	}
+}
+
+// WithIQR reports the interquartile range of histograms and timers, the
+// difference between their 75th and 25th percentiles, as name.iqr
+func WithIQR(v bool) configFn {
+	return func(r *Reporter) {
+		r.iqr = v
+	}
+}
+
+// WithMAD reports the median absolute deviation of the sampled values of
+// histograms as name.mad. Timers don't expose their sampled values, so have
+// no MAD.
+func WithMAD(v bool) configFn {
+	return func(r *Reporter) {
+		r.mad = v
+	}
+}
+
+// WithPerFlushPercentiles reports, for the counters for which fn returns
+// true, the percentiles of their increase per flush over a sample of n
+// flushes as name.per_flush.<percentile>, to analyze bursts. The option is
+// ignored, and logged, unless n is positive.
+func WithPerFlushPercentiles(fn func(name string) bool, n int) configFn {
+	return func(r *Reporter) {
+		r.perFlush = fn
+		r.perFlushWindow = n
+	}
+}
+
+// PercentileSuffixes returns the metric name suffixes of the configured
+// percentiles, such as ".pct-50.00", in the order of WithPercentiles.
+// Percentiles set per metric with WithMetricPercentiles are not included.
+func (r *Reporter) PercentileSuffixes() []string {
+	return append([]string(nil), r.p...)
+}
+
+// percentilesFor returns the percentiles of the named metric, and their
+// suffixes
+func (r *Reporter) percentilesFor(name string) ([]float64, []string) {
+	if r.metricPercentiles == nil {
+		return r.percentiles, r.p
+	}
+
+	ps := r.metricPercentiles(name)
+	if ps == nil {
+		return r.percentiles, r.p
+	}
+
+	suffixes := make([]string, len(ps))
+	for i, p := range ps {
+		suffixes[i] = r.percentileSuffix(p)
+	}
+	return ps, suffixes
+}
+
+// percentileSuffix returns the metric name suffix of percentile p
+func (r *Reporter) percentileSuffix(p float64) string {
+	if v, ok := r.percentileNames[p]; ok {
+		return v
+	}
+
+	return fmt.Sprintf(".pct-%.2f", p*100.0)
+}
+
+// percentName formats percentile p as a percentage fit for a metric name
+func percentName(p float64) string {
+	v := strconv.FormatFloat(p*100, 'f', 2, 64)
+	v = strings.TrimRight(strings.TrimRight(v, "0"), ".")
+	return strings.Replace(v, ".", "_", 1)
+}
+
+// enoughSamples returns whether a histogram or timer of the given count has
+// enough samples for its percentiles to be reported
+func (r *Reporter) enoughSamples(count int64) bool {
+	return count >= int64(r.minSamples)
+}
+
+// percentileBands returns the percentile bands to report for a histogram or
+// timer of the given count
+func (r *Reporter) percentileBands(count int64) []PercentileBand {
+	if !r.enoughSamples(count) {
+		return nil
+	}
+
+	return r.bands
+}
+
+// medianAbsoluteDeviation returns the median of the absolute deviations of
+// values from their median
+func medianAbsoluteDeviation(values []int64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	vs := make([]float64, len(values))
+	for i, v := range values {
+		vs[i] = float64(v)
+	}
+
+	m := median(vs)
+	for i, v := range vs {
+		vs[i] = math.Abs(v - m)
+	}
+	return median(vs)
+}
+
+// median returns the median of vs, sorting it in place
+func median(vs []float64) float64 {
+	sort.Float64s(vs)
+
+	n := len(vs)
+	if n%2 == 1 {
+		return vs[n/2]
+	}
+	return (vs[n/2-1] + vs[n/2]) / 2
+}
+
+// reportPerFlush records the increase of a counter in the flush, and sends the
+// percentiles of its increases in the recent flushes
+func (r *Reporter) reportPerFlush(name string, delta int64, tags []string) {
+	if r.deltas == nil {
+		r.deltas = make(map[string]metrics.Histogram)
+	}
+
+	key := r.stateKey(name)
+	h, ok := r.deltas[key]
+	if !ok {
+		h = metrics.NewHistogram(r.newSample())
+		r.deltas[key] = h
+	}
+	h.Update(delta)
+
+	ps, suffixes := r.percentilesFor(name)
+	for i, v := range h.Snapshot().Percentiles(ps) {
+		r.gauge(name+".per_flush"+suffixes[i], v, tags)
+	}
+}
@@ -0,0 +1,206 @@
+package datadog
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReporter_FlushHistogram_WithPercentileNames(t *testing.T) {
+	n := 8
+	ch := newServer(t, n)
+
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredHistogram("foo", r, metrics.NewExpDecaySample(4, 1.0))
+	c.Update(11)
+	c.Update(1)
+
+	dd, _ := New(WithAddress(addr), WithRegistry(r),
+		WithPercentiles([]float64{0.5, 0.99}),
+		WithPercentileNames(map[float64]string{0.5: ".median", 0.999: ".p999"}))
+	dd.Flush()
+
+	res := receive(t, ch, n)
+	assert.Equal(t, []string{"foo.median:6|g", "foo.pct-99.00:11|g"}, res[6:])
+}
+
+func TestReporter_FlushTimer_WithMetricPercentiles(t *testing.T) {
+	n := 7
+	ch := newServer(t, n)
+
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredTimer("foo", r)
+
+	for _, v := range []time.Duration{1, 1, 1, 1, 1, 1, 1, 1, 1, 10} {
+		c.Update(v * time.Millisecond)
+	}
+
+	dd, _ := New(WithAddress(addr), WithRegistry(r),
+		WithMetricPercentiles(func(name string) []float64 {
+			if name == "foo" {
+				return []float64{0.5, 0.95}
+			}
+			return nil
+		}))
+	dd.Flush()
+
+	res := receive(t, ch, n)
+	assert.Equal(t, []string{"foo.pct-50.00:1|g", "foo.pct-95.00:10|g"}, res[5:])
+}
+
+func TestReporter_FlushWithBoundaryPercentiles(t *testing.T) {
+	r := metrics.NewRegistry()
+	h := metrics.NewRegisteredHistogram("foo", r, metrics.NewUniformSample(8))
+	c := metrics.NewRegisteredTimer("bar", r)
+	for _, v := range []int64{3, 1, 7, 5} {
+		h.Update(v)
+		c.Update(time.Duration(v) * time.Millisecond)
+	}
+
+	dd, buf := newTestReporter(t, r, WithPercentiles([]float64{0, 0.5, 1.0}))
+	dd.Flush()
+
+	for _, e := range []string{
+		"foo.pct-0.00:1|g",
+		"foo.pct-50.00:4|g",
+		"foo.pct-100.00:7|g",
+		"bar.pct-0.00:1|g",
+		"bar.pct-50.00:4|g",
+		"bar.pct-100.00:7|g",
+	} {
+		assert.Contains(t, buf.String(), e+"\n")
+	}
+}
+
+func TestReporter_FlushWithPercentileBands(t *testing.T) {
+	r := metrics.NewRegistry()
+	h := metrics.NewRegisteredHistogram("foo", r, metrics.NewUniformSample(16))
+	c := metrics.NewRegisteredTimer("bar", r)
+	for i := int64(1); i <= 10; i++ {
+		h.Update(i * 10)
+		c.Update(time.Duration(i) * time.Millisecond)
+	}
+
+	dd, buf := newTestReporter(t, r,
+		WithPercentiles(nil), WithPercentileBands([]PercentileBand{{0.5, 0.9}, {0.25, 0.999}}))
+	dd.Flush()
+
+	for _, e := range []string{
+		"foo.band_p50_p90:44|g",
+		"foo.band_p25_p99_9:72.5|g",
+		"bar.band_p50_p90:4.4|g",
+		"bar.band_p25_p99_9:7.25|g",
+	} {
+		assert.Contains(t, buf.String(), e+"\n")
+	}
+}
+
+func TestReporter_FlushWithIQRAndMAD(t *testing.T) {
+	r := metrics.NewRegistry()
+	h := metrics.NewRegisteredHistogram("foo", r, metrics.NewUniformSample(16))
+	c := metrics.NewRegisteredTimer("bar", r)
+	for _, v := range []int64{1, 2, 3, 4, 5, 6, 7, 100} {
+		h.Update(v)
+		c.Update(time.Duration(v) * time.Millisecond)
+	}
+
+	dd, buf := newTestReporter(t, r, WithPercentiles(nil), WithIQR(true), WithMAD(true))
+	dd.Flush()
+
+	// p25 is 2.25 and p75 is 6.75; the median is 4.5, with a median absolute
+	// deviation of 2
+	assert.Contains(t, buf.String(), "foo.iqr:4.5|g\nfoo.mad:2|g\n")
+	assert.Contains(t, buf.String(), "bar.iqr:4.5|g\n")
+	assert.NotContains(t, buf.String(), "bar.mad")
+}
+
+func TestMedianAbsoluteDeviation(t *testing.T) {
+	assert.Equal(t, 0.0, medianAbsoluteDeviation(nil))
+	assert.Equal(t, 1.0, medianAbsoluteDeviation([]int64{1, 1, 2, 2, 4, 6, 9}))
+}
+
+func TestReporter_FlushWithMinSamplesForPercentiles(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredTimer("foo", r)
+	c.Update(time.Millisecond)
+	c.Update(3 * time.Millisecond)
+
+	dd, buf := newTestReporter(t, r,
+		WithPercentiles([]float64{0.99}), WithIQR(true), WithMinSamplesForPercentiles(3))
+	dd.Flush()
+
+	e := "foo.count:2|g\nfoo.max:3|g\nfoo.min:1|g\nfoo.mean:2|g\nfoo.stddev:1|g\n"
+	assert.Equal(t, e, buf.String())
+
+	c.Update(2 * time.Millisecond)
+	buf.Reset()
+	dd.Flush()
+	assert.Contains(t, buf.String(), "foo.pct-99.00:3|g\nfoo.iqr:")
+}
+
+func TestReporter_FlushWithMinSamplesForMAD(t *testing.T) {
+	r := metrics.NewRegistry()
+	h := metrics.NewRegisteredHistogram("foo", r, metrics.NewUniformSample(100))
+	h.Update(1)
+	h.Update(3)
+
+	dd, buf := newTestReporter(t, r, WithPercentiles(nil), WithMAD(true), WithMinSamplesForPercentiles(3))
+	dd.Flush()
+	assert.NotContains(t, buf.String(), "foo.mad")
+
+	h.Update(2)
+	buf.Reset()
+	dd.Flush()
+	assert.Contains(t, buf.String(), "foo.mad:1|g\n")
+}
+
+func TestReporter_FlushWithPerFlushPercentiles(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredCounter("requests", r)
+
+	dd, buf := newTestReporter(t, r,
+		WithPercentiles([]float64{0.5, 0.95}),
+		WithPercentileNames(map[float64]string{0.5: ".p50", 0.95: ".p95"}),
+		WithPerFlushPercentiles(func(name string) bool { return true }, 4))
+	assert.IsType(t, &metrics.ExpDecaySample{}, dd.newSample())
+
+	// The sample holds all 4 deltas
+	for _, d := range []int64{10, 20, 5, 100} {
+		buf.Reset()
+		c.Inc(d)
+		dd.Flush()
+	}
+
+	assert.Equal(t, "requests:100|c\nrequests.per_flush.p50:15|g\nrequests.per_flush.p95:100|g\n", buf.String())
+}
+
+func TestReporter_FlushWithPerFlushPercentilesInvalidWindow(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		var logs bytes.Buffer
+		dd, buf := newTestReporter(t, newRegistryWithCounter("requests", 1),
+			WithLogger(log.New(&logs, "", 0)),
+			WithPerFlushPercentiles(func(name string) bool { return true }, n))
+		dd.Flush()
+
+		assert.Equal(t, "requests:1|c\n", buf.String())
+		assert.Contains(t, logs.String(), fmt.Sprintf("ignoring per-flush percentiles over %d flushes", n))
+	}
+}
+
+func TestReporter_PercentileSuffixes(t *testing.T) {
+	dd, err := New(WithClient(&statsd.NoOpClient{}), WithPercentiles([]float64{0.5, 0.999, 1}),
+		WithPercentileNames(map[float64]string{1: ".max"}))
+	assert.NoError(t, err)
+
+	suffixes := dd.PercentileSuffixes()
+	assert.Equal(t, []string{".pct-50.00", ".pct-99.90", ".max"}, suffixes)
+
+	suffixes[0] = ".changed"
+	assert.Equal(t, ".pct-50.00", dd.PercentileSuffixes()[0])
+}
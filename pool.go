@@ -0,0 +1,129 @@
+package datadog
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+)
+
+// clientPool is a statsd client sending each call through the next of its
+// clients in turn
+type clientPool struct {
+	clients []statsd.ClientInterface
+	next    uint32
+}
+
+// Verify that clientPool implements the ClientInterface
+var _ statsd.ClientInterface = &clientPool{}
+
+// client returns the client for the next call
+func (p *clientPool) client() statsd.ClientInterface {
+	n := atomic.AddUint32(&p.next, 1)
+	return p.clients[(n-1)%uint32(len(p.clients))]
+}
+
+func (p *clientPool) Gauge(name string, value float64, tags []string, rate float64) error {
+	return p.client().Gauge(name, value, tags, rate)
+}
+
+func (p *clientPool) Count(name string, value int64, tags []string, rate float64) error {
+	return p.client().Count(name, value, tags, rate)
+}
+
+func (p *clientPool) Histogram(name string, value float64, tags []string, rate float64) error {
+	return p.client().Histogram(name, value, tags, rate)
+}
+
+func (p *clientPool) Distribution(name string, value float64, tags []string, rate float64) error {
+	return p.client().Distribution(name, value, tags, rate)
+}
+
+func (p *clientPool) Decr(name string, tags []string, rate float64) error {
+	return p.client().Decr(name, tags, rate)
+}
+
+func (p *clientPool) Incr(name string, tags []string, rate float64) error {
+	return p.client().Incr(name, tags, rate)
+}
+
+func (p *clientPool) Set(name string, value string, tags []string, rate float64) error {
+	return p.client().Set(name, value, tags, rate)
+}
+
+func (p *clientPool) Timing(name string, value time.Duration, tags []string, rate float64) error {
+	return p.client().Timing(name, value, tags, rate)
+}
+
+func (p *clientPool) TimeInMilliseconds(name string, value float64, tags []string, rate float64) error {
+	return p.client().TimeInMilliseconds(name, value, tags, rate)
+}
+
+func (p *clientPool) Event(e *statsd.Event) error {
+	return p.client().Event(e)
+}
+
+func (p *clientPool) SimpleEvent(title, text string) error {
+	return p.client().SimpleEvent(title, text)
+}
+
+func (p *clientPool) ServiceCheck(sc *statsd.ServiceCheck) error {
+	return p.client().ServiceCheck(sc)
+}
+
+func (p *clientPool) SimpleServiceCheck(name string, status statsd.ServiceCheckStatus) error {
+	return p.client().SimpleServiceCheck(name, status)
+}
+
+// FlushTelemetryMetrics returns the sum of the telemetry of the clients
+// supporting it
+func (p *clientPool) FlushTelemetryMetrics() statsd.ClientMetrics {
+	var res statsd.ClientMetrics
+	for _, cn := range p.clients {
+		if cn, ok := cn.(TelemetryClient); ok {
+			m := cn.FlushTelemetryMetrics()
+			res.TotalMetrics += m.TotalMetrics
+			res.TotalMetricsGauge += m.TotalMetricsGauge
+			res.TotalMetricsCount += m.TotalMetricsCount
+			res.TotalMetricsHistogram += m.TotalMetricsHistogram
+			res.TotalMetricsDistribution += m.TotalMetricsDistribution
+			res.TotalMetricsSet += m.TotalMetricsSet
+			res.TotalMetricsTiming += m.TotalMetricsTiming
+			res.TotalEvents += m.TotalEvents
+			res.TotalServiceChecks += m.TotalServiceChecks
+			res.TotalDroppedOnReceive += m.TotalDroppedOnReceive
+		}
+	}
+
+	return res
+}
+
+// Close closes all clients, returning the first error
+func (p *clientPool) Close() error {
+	return p.each(statsd.ClientInterface.Close)
+}
+
+// Flush flushes all clients, returning the first error
+func (p *clientPool) Flush() error {
+	return p.each(statsd.ClientInterface.Flush)
+}
+
+// SetWriteTimeout sets the write timeout of all clients, returning the first
+// error
+func (p *clientPool) SetWriteTimeout(d time.Duration) error {
+	return p.each(func(cn statsd.ClientInterface) error {
+		return cn.SetWriteTimeout(d)
+	})
+}
+
+// each calls fn with every client, returning the first error
+func (p *clientPool) each(fn func(statsd.ClientInterface) error) error {
+	var res error
+	for _, cn := range p.clients {
+		if err := fn(cn); err != nil && res == nil {
+			res = err
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,96 @@
+package datadog
+
+import (
+	"net"
+	"testing"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingClient is a statsd client counting the gauges it is sent
+type countingClient struct {
+	statsd.NoOpClient
+	gauges int
+	closed bool
+}
+
+func (c *countingClient) Gauge(name string, value float64, tags []string, rate float64) error {
+	c.gauges++
+	return nil
+}
+
+func (c *countingClient) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestClientPool(t *testing.T) {
+	clients := []*countingClient{{}, {}, {}}
+	pool := &clientPool{}
+	for _, cn := range clients {
+		pool.clients = append(pool.clients, cn)
+	}
+
+	r := metrics.NewRegistry()
+	metrics.NewRegisteredHistogram("foo", r, metrics.NewUniformSample(4)).Update(1)
+
+	dd, _ := New(WithClient(pool), WithRegistry(r), WithPercentiles([]float64{0.5, 0.75, 0.99}))
+	dd.Flush()
+	assert.NoError(t, dd.Close())
+
+	for _, cn := range clients {
+		assert.Equal(t, 3, cn.gauges)
+		assert.True(t, cn.closed)
+	}
+}
+
+func TestNew_WithConnectionPool(t *testing.T) {
+	dd, err := New(WithAddress(addr), WithConnectionPool(3))
+	assert.NoError(t, err)
+	defer dd.Close()
+
+	if assert.IsType(t, &clientPool{}, dd.cn) {
+		assert.Len(t, dd.cn.(*clientPool).clients, 3)
+	}
+}
+
+func benchmarkFlush(b *testing.B, options ...configFn) {
+	cn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cn.Close()
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			if _, _, err := cn.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	r := metrics.NewRegistry()
+	for i := 0; i < 100; i++ {
+		metrics.NewRegisteredTimer(string(rune('a'+i%26))+string(rune('a'+i/26)), r).Update(1)
+	}
+
+	options = append(options, WithAddress(cn.LocalAddr().String()), WithRegistry(r), WithMaxInflight(8))
+	dd, _ := New(options...)
+	defer dd.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dd.Flush()
+	}
+}
+
+func BenchmarkReporter_Flush(b *testing.B) {
+	benchmarkFlush(b)
+}
+
+func BenchmarkReporter_FlushWithConnectionPool(b *testing.B) {
+	benchmarkFlush(b, WithConnectionPool(4))
+}
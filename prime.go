@@ -0,0 +1,67 @@
+package datadog
+
+import (
+	"github.com/rcrowley/go-metrics"
+)
+
+// Prime records the current state of the metrics without sending anything, so
+// that the first flush reports only what changed from now on: the increase of
+// counters, meters, timer ops, monotonic gauges and histogram sum totals rather
+// than their whole count, the change of gauges reported with WithGaugeDelta,
+// and only the new values of histograms and timers reported as distributions.
+// It is meant to be called right after New, when reporting the metrics of an
+// application that has been running for a while.
+func (r *Reporter) Prime() {
+	r.flushMu.Lock()
+	defer r.flushMu.Unlock()
+
+	for _, e := range r.collect() {
+		r.source, r.sourceRegistry = e.tag, e.registry
+		switch metric := e.metric.(type) {
+		case metrics.Counter:
+			r.ss[r.stateKey(e.name)] = metric.Count()
+		case metrics.Meter:
+			r.ss[r.stateKey(e.name)] = metric.Count()
+		case metrics.Gauge:
+			r.primeGauge(e.name, r.gaugeValue(e.name, float64(metric.Value())))
+		case metrics.GaugeFloat64:
+			r.primeGauge(e.name, r.gaugeValue(e.name, metric.Value()))
+		case metrics.Histogram:
+			if r.sumTotal != nil && r.sumTotal(e.name) {
+				r.ss[r.stateKey(e.name+".sum_total")] = metric.Sum()
+			}
+			if r.histogramDist != nil && r.histogramDist(e.name) {
+				r.ss[r.stateKey(e.name+"|d")] = metric.Count()
+			}
+		case metrics.Timer:
+			if r.timerOps {
+				r.ss[r.stateKey(e.name+r.timerOpsSuffix)] = metric.Count()
+			}
+			switch r.timerMode {
+			case TimerDistribution:
+				r.ss[r.stateKey(e.name+"|d")] = metric.Count()
+			case TimerSummaryAndDistribution:
+				r.ss[r.stateKey(e.name+".dist|d")] = metric.Count()
+			}
+		}
+	}
+	r.source, r.sourceRegistry = "", 0
+}
+
+// primeGauge records the value of a gauge for Prime, as reportGauge does for
+// the gauges reported as deltas or monotonic counts
+func (r *Reporter) primeGauge(name string, v float64) {
+	if r.gaugeDelta != nil && r.gaugeDelta(name) {
+		if r.lastGauges == nil {
+			r.lastGauges = make(map[string]float64)
+		}
+		r.lastGauges[r.stateKey(name)] = v
+	}
+
+	if (r.monotonicCount != nil && r.monotonicCount(name)) || (r.monotonic != nil && r.monotonic(name)) {
+		if r.gs == nil {
+			r.gs = make(map[string]float64)
+		}
+		r.gs[r.stateKey(name)] = v
+	}
+}
@@ -0,0 +1,125 @@
+package datadog
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReporter_Prime(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := metrics.NewRegisteredCounter("foo", r)
+	m := metrics.NewRegisteredMeter("bar", r)
+	c.Inc(1000)
+	m.Mark(500)
+
+	dd, buf := newTestReporter(t, r, WithMeterDelta(true), WithInstantaneousMeterRate(true))
+	dd.Prime()
+	assert.Empty(t, buf.String())
+
+	dd.Flush()
+	assert.Contains(t, buf.String(), "foo:0|c\n")
+	assert.Contains(t, buf.String(), "bar.count:0|c\n")
+
+	c.Inc(3)
+	m.Mark(2)
+	buf.Reset()
+	dd.Flush()
+	assert.Contains(t, buf.String(), "foo:3|c\n")
+	assert.Contains(t, buf.String(), "bar.count:2|c\n")
+}
+
+func TestReporter_PrimeWithMonotonicGauges(t *testing.T) {
+	r := metrics.NewRegistry()
+	g := metrics.NewRegisteredGauge("bytes", r)
+	g.Update(1000)
+
+	dd, buf := newTestReporter(t, r, WithMonotonicGauges(func(name string) bool { return name == "bytes" }))
+	dd.Prime()
+	dd.Flush()
+	assert.Equal(t, "bytes:0|c\n", buf.String())
+
+	g.Update(1030)
+	buf.Reset()
+	dd.Flush()
+	assert.Equal(t, "bytes:30|c\n", buf.String())
+}
+
+func TestReporter_PrimeWithGaugeDelta(t *testing.T) {
+	r := metrics.NewRegistry()
+	g := metrics.NewRegisteredGaugeFloat64("queue", r)
+	g.Update(3)
+
+	dd, buf := newTestReporter(t, r, WithGaugeDelta(func(name string) bool { return name == "queue" }))
+	dd.Prime()
+	dd.Flush()
+	assert.Equal(t, "queue:3|g\nqueue.delta:0|g\n", buf.String())
+
+	g.Update(7)
+	buf.Reset()
+	dd.Flush()
+	assert.Equal(t, "queue:7|g\nqueue.delta:4|g\n", buf.String())
+}
+
+func TestReporter_PrimeWithHistogramDistributions(t *testing.T) {
+	r := metrics.NewRegistry()
+	h := metrics.NewRegisteredHistogram("foo", r, metrics.NewUniformSample(100))
+	for i := int64(1); i <= 100; i++ {
+		h.Update(i)
+	}
+
+	dd, buf := newTestReporter(t, r,
+		WithHistogramDistributions(func(name string) bool { return name == "foo" }, 4))
+	dd.Prime()
+	dd.Flush()
+	assert.NotContains(t, buf.String(), "|d\n")
+
+	h.Update(50)
+	buf.Reset()
+	dd.Flush()
+	assert.Equal(t, 1, strings.Count(buf.String(), "foo:"))
+}
+
+func TestReporter_PrimeWithTimerDistributions(t *testing.T) {
+	for _, tt := range []struct {
+		mode TimerMode
+		name string
+	}{
+		{TimerDistribution, "foo"},
+		{TimerSummaryAndDistribution, "foo.dist"},
+	} {
+		r := metrics.NewRegistry()
+		tm := metrics.NewRegisteredTimer("foo", r)
+		tm.Update(time.Second)
+
+		dd, buf := newTestReporter(t, r, WithPercentiles(nil), WithTimerMode(tt.mode))
+		dd.Prime()
+		dd.Flush()
+		assert.NotContains(t, buf.String(), "|d\n", tt.name)
+
+		tm.Update(time.Second)
+		buf.Reset()
+		dd.Flush()
+		assert.Contains(t, buf.String(), tt.name+":1000|d\n", tt.name)
+	}
+}
+
+func TestReporter_PrimeWithHistogramSumTotal(t *testing.T) {
+	r := metrics.NewRegistry()
+	h := metrics.NewRegisteredHistogram("bytes", r, metrics.NewUniformSample(16))
+	h.Update(100)
+
+	dd, buf := newTestReporter(t, r,
+		WithPercentiles(nil), WithHistogramSumTotal(func(name string) bool { return name == "bytes" }))
+	dd.Prime()
+	dd.Flush()
+	assert.Contains(t, buf.String(), "bytes.sum_total:0|c\n")
+
+	h.Update(30)
+	buf.Reset()
+	dd.Flush()
+	assert.Contains(t, buf.String(), "bytes.sum_total:30|c\n")
+}
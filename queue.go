@@ -0,0 +1,58 @@
+package datadog
+
+// WithQueueBuffer sends metrics from a goroutine of its own, through a queue
+// of n metrics, so that a flush scans the registry while the metrics scanned
+// are being sent. A flush still waits for the queue to drain. When the queue
+// is full, the flush waits for room, or drops the metric with drop, counting
+// it as queue_full with WithDroppedCounter. It takes precedence over
+// WithMaxInflight.
+func WithQueueBuffer(n int, drop bool) configFn {
+	return func(r *Reporter) {
+		r.queue = nil
+		if n > 0 {
+			r.queue = make(chan func() error, n)
+		}
+		r.queueDrop = drop
+	}
+}
+
+// enqueue queues send for the sender goroutine, or drops it when the queue is
+// full with WithQueueBuffer(n, true)
+func (r *Reporter) enqueue(send func() error) {
+	r.wg.Add(1)
+	select {
+	case r.queue <- send:
+	default:
+		if r.queueDrop {
+			r.wg.Done()
+			r.drop("queue_full")
+			return
+		}
+		r.queue <- send
+	}
+	r.stats.Emissions++
+}
+
+// sendQueued sends the metrics queued by flushes until the queue is closed
+func (r *Reporter) sendQueued(queue <-chan func() error) {
+	for send := range queue {
+		r.fail(send())
+		r.wg.Done()
+	}
+}
+
+// stopQueue stops the sender goroutine, once no flush is in progress. Later
+// flushes send their metrics right away.
+func (r *Reporter) stopQueue() {
+	if r.queue == nil {
+		return
+	}
+
+	r.flushMu.Lock()
+	defer r.flushMu.Unlock()
+
+	r.queueStop.Do(func() {
+		close(r.queue)
+		r.queueClosed = true
+	})
+}
@@ -0,0 +1,128 @@
+package datadog
+
+import (
+	"bytes"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReporter_FlushWithQueueBuffer(t *testing.T) {
+	r := metrics.NewRegistry()
+	for i := 0; i < 50; i++ {
+		metrics.NewRegisteredGauge("g"+strconv.Itoa(i), r).Update(1)
+	}
+
+	cn := &countingClient{}
+	var stats FlushStats
+	dd, _ := New(WithClient(cn), WithRegistry(r), WithQueueBuffer(4, false),
+		WithOnFlush(func(s FlushStats) { stats = s }))
+
+	for i := 1; i <= 2; i++ {
+		assert.NoError(t, dd.Flush())
+		assert.Equal(t, 50*i, cn.gauges)
+		assert.Equal(t, 50, stats.Emissions)
+	}
+
+	// Flushes after Close send right away
+	assert.NoError(t, dd.Close())
+	assert.Eventually(t, func() bool {
+		dd.flushMu.Lock()
+		defer dd.flushMu.Unlock()
+		return dd.queueClosed
+	}, testWaitTimeout, time.Millisecond)
+	dd.Flush()
+	assert.Equal(t, 150, cn.gauges)
+}
+
+// signalSink is a file sink calling first before writing the first line, and
+// closing found once a line contains the given text
+type signalSink struct {
+	bytes.Buffer
+	first func()
+	text  string
+	found chan struct{}
+}
+
+func (s *signalSink) Write(p []byte) (int, error) {
+	if s.Len() == 0 {
+		s.first()
+	}
+	if bytes.Contains(p, []byte(s.text)) {
+		close(s.found)
+	}
+	return s.Buffer.Write(p)
+}
+
+func TestReporter_FlushWithQueueBufferDrop(t *testing.T) {
+	r := metrics.NewRegistry()
+	for i := 0; i < 10; i++ {
+		metrics.NewRegisteredGauge("g"+strconv.Itoa(i), r).Update(1)
+	}
+
+	cn := &blockingClient{release: make(chan struct{})}
+	sink := &signalSink{text: droppedMetric, found: make(chan struct{})}
+
+	// The first gauge is written to the sink once the sender is blocked
+	// sending it
+	sink.first = func() {
+		for atomic.LoadInt32(&cn.inflight) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	dd, _ := New(WithClient(cn), WithRegistry(r), WithFileSink(sink), WithQueueBuffer(2, true),
+		WithDroppedCounter(true))
+
+	done := make(chan error)
+	go func() { done <- dd.Flush() }()
+
+	// Two more gauges are queued, and the others are dropped
+	<-sink.found
+	close(cn.release)
+
+	assert.NoError(t, <-done)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&cn.sent))
+	assert.Contains(t, sink.String(), droppedMetric+":7|c|#reason:queue_full\n")
+}
+
+// slowClient is a statsd client taking a while to send each gauge, like one
+// making a syscall per gauge
+type slowClient struct {
+	statsd.NoOpClient
+}
+
+func (c *slowClient) Gauge(name string, value float64, tags []string, rate float64) error {
+	for start := time.Now(); time.Since(start) < 5*time.Microsecond; {
+	}
+	return nil
+}
+
+func benchmarkSlowFlush(b *testing.B, options ...configFn) {
+	r := metrics.NewRegistry()
+	for i := 0; i < 100; i++ {
+		metrics.NewRegisteredTimer("t"+strconv.Itoa(i), r).Update(time.Millisecond)
+	}
+
+	options = append(options, WithClient(&slowClient{}), WithRegistry(r))
+	dd, _ := New(options...)
+	defer dd.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dd.Flush()
+	}
+}
+
+func BenchmarkReporter_FlushSlowClient(b *testing.B) {
+	benchmarkSlowFlush(b)
+}
+
+// Scanning the registry overlaps with the sends of the queue
+func BenchmarkReporter_FlushSlowClientWithQueueBuffer(b *testing.B) {
+	benchmarkSlowFlush(b, WithQueueBuffer(256, false))
+}
@@ -0,0 +1,134 @@
+package datadog
+
+import (
+	"strconv"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// allRegistries returns the registries from which metrics are reported
+func (r *Reporter) allRegistries() []metrics.Registry {
+	if len(r.registries) > 0 {
+		return r.registries
+	}
+
+	return []metrics.Registry{r.registry}
+}
+
+// mergeEntries combines the snapshots of metrics of the same name, keeping the
+// order in which names were first seen
+func mergeEntries(entries []entry) []entry {
+	var res []entry
+	seen := make(map[string]int)
+
+	for _, e := range entries {
+		i, ok := seen[e.name]
+		if !ok {
+			seen[e.name] = len(res)
+			res = append(res, e)
+			continue
+		}
+
+		res[i].metric = merge(res[i].metric, e.metric)
+	}
+
+	return res
+}
+
+// merge combines two metric snapshots, or returns a when they can't be
+// combined
+func merge(a, b interface{}) interface{} {
+	switch x := a.(type) {
+	case metrics.Counter:
+		if y, ok := b.(metrics.Counter); ok {
+			return metrics.CounterSnapshot(x.Count() + y.Count())
+		}
+
+	case metrics.Histogram:
+		if y, ok := b.(metrics.Histogram); ok {
+			values := append(append([]int64(nil), x.Sample().Values()...), y.Sample().Values()...)
+			s := metrics.NewSampleSnapshot(x.Count()+y.Count(), values)
+			return metrics.NewHistogram(s).Snapshot()
+		}
+
+	case metrics.Meter:
+		if y, ok := b.(metrics.Meter); ok {
+			return &meterSum{
+				count:    x.Count() + y.Count(),
+				rate1:    x.Rate1() + y.Rate1(),
+				rate5:    x.Rate5() + y.Rate5(),
+				rate15:   x.Rate15() + y.Rate15(),
+				rateMean: x.RateMean() + y.RateMean(),
+			}
+		}
+	}
+
+	return a
+}
+
+// meterSum is a read-only sum of meters
+type meterSum struct {
+	count                          int64
+	rate1, rate5, rate15, rateMean float64
+}
+
+func (m *meterSum) Count() int64            { return m.count }
+func (m *meterSum) Mark(n int64)            { panic("Mark called on a meterSum") }
+func (m *meterSum) Rate1() float64          { return m.rate1 }
+func (m *meterSum) Rate5() float64          { return m.rate5 }
+func (m *meterSum) Rate15() float64         { return m.rate15 }
+func (m *meterSum) RateMean() float64       { return m.rateMean }
+func (m *meterSum) Snapshot() metrics.Meter { return m }
+func (m *meterSum) Stop()                   {}
+
+// resolveConflicts renames or tags metrics of the same name found in several
+// registries, according to the conflict policy
+func (r *Reporter) resolveConflicts(entries []entry) []entry {
+	registries := make(map[string]map[int]bool)
+	for _, e := range entries {
+		if registries[e.name] == nil {
+			registries[e.name] = make(map[int]bool)
+		}
+		registries[e.name][e.registry] = true
+	}
+
+	for i, e := range entries {
+		if len(registries[e.name]) < 2 {
+			continue
+		}
+
+		switch r.conflictPolicy {
+		case ConflictSuffix:
+			// The suffix is the number of earlier registries with a metric of
+			// the same name
+			n := 0
+			for j := range registries[e.name] {
+				if j < e.registry {
+					n++
+				}
+			}
+			if n > 0 {
+				entries[i].name = e.name + "_" + strconv.Itoa(n)
+			}
+		case ConflictTag:
+			entries[i].tag = "registry:" + strconv.Itoa(e.registry)
+		}
+	}
+
+	return entries
+}
+
+// stateKey returns the key of the state kept between flushes for the named
+// metric of the current source and registry, so that metrics of the same name
+// from several registries don't share state unless they are merged
+func (r *Reporter) stateKey(name string) string {
+	key := name
+	if r.source != "" {
+		key += "|" + r.source
+	}
+	if len(r.registries) > 1 && !r.mergeRegistries && r.aggregator == nil {
+		key += "|" + strconv.Itoa(r.sourceRegistry)
+	}
+
+	return key
+}
@@ -0,0 +1,167 @@
+package datadog
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReporter_FlushWithMergedRegistries(t *testing.T) {
+	a, b := metrics.NewRegistry(), metrics.NewRegistry()
+	ca := metrics.NewRegisteredCounter("requests", a)
+	cb := metrics.NewRegisteredCounter("requests", b)
+	metrics.NewRegisteredHistogram("size", a, metrics.NewUniformSample(4)).Update(1)
+	metrics.NewRegisteredHistogram("size", b, metrics.NewUniformSample(4)).Update(3)
+	metrics.NewRegisteredMeter("hits", a).Mark(2)
+	metrics.NewRegisteredMeter("hits", b).Mark(5)
+
+	var buf bytes.Buffer
+	dd, _ := New(WithClient(&statsd.NoOpClient{}), WithRegistries(a, b),
+		WithPercentiles(nil), WithFileSink(&buf), WithMergedRegistries(true))
+
+	ca.Inc(2)
+	cb.Inc(3)
+	dd.Flush()
+
+	assert.Equal(t, 1, bytes.Count(buf.Bytes(), []byte("requests:")))
+	assert.Contains(t, buf.String(), "requests:5|c\n")
+	assert.Contains(t, buf.String(), "size.count:2|g\nsize.max:3|g\nsize.min:1|g\nsize.mean:2|g\n")
+	assert.Contains(t, buf.String(), "hits.count:7|g\n")
+
+	buf.Reset()
+	ca.Inc(1)
+	cb.Inc(1)
+	dd.Flush()
+
+	assert.Contains(t, buf.String(), "requests:2|c\n")
+}
+
+func TestReporter_FlushWithRegistries(t *testing.T) {
+	a, b := newRegistryWithCounter("foo", 1), newRegistryWithCounter("bar", 2)
+
+	var buf bytes.Buffer
+	dd, _ := New(WithClient(&statsd.NoOpClient{}), WithRegistries(a, b), WithFileSink(&buf))
+	dd.Flush()
+
+	assert.Equal(t, "foo:1|c\nbar:2|c\n", buf.String())
+}
+
+func TestReporter_FlushWithRegistriesUnchanged(t *testing.T) {
+	a, b := newRegistryWithCounter("requests", 10), newRegistryWithCounter("requests", 3)
+
+	var buf bytes.Buffer
+	dd, _ := New(WithClient(&statsd.NoOpClient{}), WithRegistries(a, b), WithFileSink(&buf))
+	dd.Flush()
+	assert.Equal(t, "requests:10|c\nrequests:3|c\n", buf.String())
+
+	// Each counter keeps its own delta, so nothing changed is nothing counted
+	for i := 0; i < 2; i++ {
+		buf.Reset()
+		dd.Flush()
+		assert.Equal(t, "requests:0|c\nrequests:0|c\n", buf.String())
+	}
+}
+
+func TestReporter_FlushWithConflictPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		policy ConflictPolicy
+		e      []string
+	}{
+		{ConflictOverwrite, []string{"foo:1|c\nfoo:2|c\nbar:3|c\n", "foo:1|c\nfoo:1|c\nbar:0|c\n"}},
+		{ConflictSuffix, []string{"foo:1|c\nfoo_1:2|c\nbar:3|c\n", "foo:1|c\nfoo_1:1|c\nbar:0|c\n"}},
+		{ConflictTag, []string{
+			"foo:1|c|#registry:0\nfoo:2|c|#registry:1\nbar:3|c\n",
+			"foo:1|c|#registry:0\nfoo:1|c|#registry:1\nbar:0|c\n",
+		}},
+	} {
+		a, b, c := newRegistryWithCounter("foo", 1), newRegistryWithCounter("foo", 2), newRegistryWithCounter("bar", 3)
+
+		var buf bytes.Buffer
+		dd, _ := New(WithClient(&statsd.NoOpClient{}), WithRegistries(a, b, c), WithFileSink(&buf),
+			WithConflictPolicy(tt.policy))
+
+		for _, e := range tt.e {
+			buf.Reset()
+			dd.Flush()
+			assert.Equal(t, e, buf.String())
+
+			// Both counters increase by 1, and deltas are kept apart
+			a.Get("foo").(metrics.Counter).Inc(1)
+			b.Get("foo").(metrics.Counter).Inc(1)
+		}
+	}
+}
+
+func TestReporter_FlushWithConflictOverwrite(t *testing.T) {
+	a, b := metrics.NewRegistry(), metrics.NewRegistry()
+	ca := metrics.NewRegisteredCounter("requests", a)
+	cb := metrics.NewRegisteredCounter("requests", b)
+	ma := metrics.NewRegisteredMeter("hits", a)
+	mb := metrics.NewRegisteredMeter("hits", b)
+
+	var buf bytes.Buffer
+	dd, _ := New(WithClient(&statsd.NoOpClient{}), WithRegistries(a, b), WithFileSink(&buf),
+		WithConflictPolicy(ConflictOverwrite), WithMeterDelta(true))
+
+	// The names are kept, but the deltas of counters and meters are not shared
+	counts := func() []string {
+		var res []string
+		for _, l := range strings.Split(buf.String(), "\n") {
+			if strings.HasPrefix(l, "requests:") || strings.HasPrefix(l, "hits.count:") {
+				res = append(res, l)
+			}
+		}
+		buf.Reset()
+		return res
+	}
+
+	ca.Inc(10)
+	cb.Inc(3)
+	ma.Mark(4)
+	mb.Mark(1)
+	dd.Flush()
+	assert.ElementsMatch(t, []string{"requests:10|c", "hits.count:4|c", "requests:3|c", "hits.count:1|c"}, counts())
+
+	dd.Flush()
+	assert.ElementsMatch(t, []string{"requests:0|c", "hits.count:0|c", "requests:0|c", "hits.count:0|c"}, counts())
+
+	ca.Inc(2)
+	mb.Mark(5)
+	dd.Flush()
+	assert.ElementsMatch(t, []string{"requests:2|c", "hits.count:0|c", "requests:0|c", "hits.count:5|c"}, counts())
+}
+
+func TestReporter_FlushWithAggregator(t *testing.T) {
+	a, b := newRegistryWithCounter("requests", 1), newRegistryWithCounter("requests", 2)
+	metrics.NewRegisteredGauge("workers", b).Update(4)
+
+	// The aggregator sums the counters of all registries, and keeps gauges as
+	// they are
+	sum := func(registries []metrics.Registry) map[string]interface{} {
+		res := make(map[string]interface{})
+		var total int64
+		for _, registry := range registries {
+			registry.Each(func(name string, i interface{}) {
+				if c, ok := i.(metrics.Counter); ok {
+					total += c.Count()
+				} else {
+					res[name] = i
+				}
+			})
+		}
+		res["requests.total"] = metrics.CounterSnapshot(total)
+		res["unsupported"] = "value"
+		return res
+	}
+
+	var buf bytes.Buffer
+	dd, _ := New(WithClient(&statsd.NoOpClient{}), WithRegistries(a, b), WithFileSink(&buf),
+		WithAggregator(sum))
+	dd.Flush()
+
+	assert.Equal(t, "requests.total:3|c\nworkers:4|g\n", buf.String())
+}
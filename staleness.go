@@ -0,0 +1,51 @@
+package datadog
+
+import (
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// lastChange is the value of a metric when it last changed, and when
+type lastChange struct {
+	value float64
+	at    time.Time
+}
+
+// reportStaleness sends the time since the value of a metric last changed as
+// name.staleness_seconds. A metric is taken to have changed when first seen.
+func (r *Reporter) reportStaleness(name string, i interface{}, now time.Time) {
+	if r.changed == nil {
+		r.changed = make(map[string]lastChange)
+	}
+
+	v := valueOf(i)
+	l, ok := r.changed[r.stateKey(name)]
+	if !ok || l.value != v {
+		l = lastChange{v, now}
+		r.changed[r.stateKey(name)] = l
+	}
+
+	r.gauge(name+".staleness_seconds", now.Sub(l.at).Seconds(), r.tagsFor(name, originOf(i)))
+}
+
+// valueOf returns the value of a metric snapshot that changes when it is
+// updated: the value of gauges, and the count of other metrics
+func valueOf(i interface{}) float64 {
+	switch metric := i.(type) {
+	case metrics.Counter:
+		return float64(metric.Count())
+	case metrics.Gauge:
+		return float64(metric.Value())
+	case metrics.GaugeFloat64:
+		return metric.Value()
+	case metrics.Histogram:
+		return float64(metric.Count())
+	case metrics.Meter:
+		return float64(metric.Count())
+	case metrics.Timer:
+		return float64(metric.Count())
+	}
+
+	return 0
+}
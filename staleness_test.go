@@ -0,0 +1,43 @@
+package datadog
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReporter_FlushWithStalenessMetric(t *testing.T) {
+	r := metrics.NewRegistry()
+	g := metrics.NewRegisteredGauge("foo", r)
+	metrics.NewRegisteredCounter("bar", r)
+
+	now := time.Unix(1000, 0)
+	dd, buf := newTestReporter(t, r, WithStalenessMetric(func(name string) bool { return name == "foo" }))
+	dd.now = func() time.Time { return now }
+
+	var staleness []string
+	for i, v := range []int64{1, 2, 2, 2} {
+		g.Update(v)
+		now = time.Unix(1000, 0).Add(time.Duration(i) * 10 * time.Second)
+		buf.Reset()
+		dd.Flush()
+
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if strings.HasPrefix(line, "foo.staleness_seconds:") {
+				staleness = append(staleness, line)
+			}
+		}
+		assert.NotContains(t, buf.String(), "bar.staleness_seconds")
+	}
+
+	e := []string{
+		"foo.staleness_seconds:0|g",
+		"foo.staleness_seconds:0|g",
+		"foo.staleness_seconds:10|g",
+		"foo.staleness_seconds:20|g",
+	}
+	assert.Equal(t, e, staleness)
+}
@@ -0,0 +1,41 @@
+package datadog
+
+import (
+	"context"
+	"time"
+)
+
+// Start runs FlushWithInterval until ctx is done, then flushes the metrics a
+// last time and closes the reporter. The returned channel receives the error
+// of the final flush or of closing, or nil, and is then closed. When the
+// reporter is closed by other means first, it receives nil without flushing.
+func (r *Reporter) Start(ctx context.Context, i time.Duration) <-chan error {
+	done := make(chan error, 1)
+	loop := make(chan struct{})
+	go func() {
+		defer close(loop)
+		r.FlushWithInterval(i)
+	}()
+
+	go func() {
+		defer close(done)
+
+		select {
+		case <-ctx.Done():
+		case <-loop:
+			done <- nil
+			return
+		}
+
+		var err error
+		if !r.blockingFlush {
+			err = r.Flush()
+		}
+		if cerr := r.Close(); err == nil {
+			err = cerr
+		}
+		done <- err
+	}()
+
+	return done
+}
@@ -0,0 +1,57 @@
+package datadog
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReporter_Start(t *testing.T) {
+	dd, buf := newTestReporter(t, newRegistryWithCounter("foo", 1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := dd.Start(ctx, time.Hour)
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(testWaitTimeout):
+		t.Fatal("reporter did not stop")
+	}
+	_, ok := <-done
+	assert.False(t, ok)
+	assert.Equal(t, "foo:1|c\n", buf.String())
+}
+
+func TestReporter_StartFinalFlushError(t *testing.T) {
+	dd, _ := New(WithClient(&failingClient{}), WithRegistry(newRegistryWithCounter("foo", 1)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := dd.Start(ctx, time.Hour)
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.EqualError(t, err, "count failed")
+	case <-time.After(testWaitTimeout):
+		t.Fatal("reporter did not stop")
+	}
+}
+
+func TestReporter_StartClosed(t *testing.T) {
+	dd, buf := newTestReporter(t, newRegistryWithCounter("foo", 1))
+
+	done := dd.Start(context.Background(), time.Hour)
+	assert.NoError(t, dd.Close())
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(testWaitTimeout):
+		t.Fatal("reporter did not stop")
+	}
+	assert.Empty(t, buf.String())
+}
@@ -0,0 +1,64 @@
+package datadog
+
+import (
+	"time"
+)
+
+// TriggerFlush requests a flush of the metrics, such as after processing a
+// batch, without waiting for it. The flush runs right away unless one ran less
+// than the minimum interval set with WithMinFlushInterval ago, in which case
+// it runs once that interval has passed. Triggers made while a flush is
+// pending are coalesced into it. It has no effect once the reporter is closed.
+func (r *Reporter) TriggerFlush() {
+	r.triggerMu.Lock()
+	defer r.triggerMu.Unlock()
+
+	select {
+	case <-r.stop:
+		return
+	default:
+	}
+
+	if r.trigger != nil {
+		return
+	}
+
+	wait := r.minFlushInterval - r.now().Sub(r.triggered)
+	if wait < 0 {
+		wait = 0
+	}
+	r.trigger = time.AfterFunc(wait, r.triggeredFlush)
+}
+
+// triggeredFlush runs a flush requested with TriggerFlush, unless the reporter
+// is closed
+func (r *Reporter) triggeredFlush() {
+	r.triggerMu.Lock()
+	r.trigger = nil
+	r.triggered = r.now()
+	r.triggerMu.Unlock()
+
+	r.loopMu.Lock()
+	select {
+	case <-r.stop:
+		r.loopMu.Unlock()
+		return
+	default:
+	}
+	r.loop.Add(1)
+	r.loopMu.Unlock()
+	defer r.loop.Done()
+
+	r.Flush()
+}
+
+// stopTrigger cancels a pending triggered flush
+func (r *Reporter) stopTrigger() {
+	r.triggerMu.Lock()
+	defer r.triggerMu.Unlock()
+
+	if r.trigger != nil {
+		r.trigger.Stop()
+		r.trigger = nil
+	}
+}
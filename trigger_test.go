@@ -0,0 +1,65 @@
+package datadog
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReporter_TriggerFlush(t *testing.T) {
+	// The clock is read by the triggered flushes, from the goroutine of their
+	// timer
+	now := time.Unix(1600000000, 0).UnixNano()
+	advance := func(d time.Duration) { atomic.AddInt64(&now, int64(d)) }
+
+	var flushes int32
+	dd, _ := New(WithClient(&statsd.NoOpClient{}), WithRegistry(metrics.NewRegistry()),
+		WithMinFlushInterval(time.Hour),
+		WithOnFlush(func(FlushStats) { atomic.AddInt32(&flushes, 1) }))
+	dd.now = func() time.Time { return time.Unix(0, atomic.LoadInt64(&now)) }
+	defer dd.Close()
+
+	// The first trigger flushes right away
+	dd.TriggerFlush()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&flushes) == 1 }, time.Second, time.Millisecond)
+
+	// Triggers less than the interval after the flush are coalesced into a
+	// single flush once it has passed
+	advance(time.Hour - 20*time.Millisecond)
+	for i := 0; i < 100; i++ {
+		dd.TriggerFlush()
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&flushes))
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&flushes) == 2 }, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&flushes))
+
+	// A trigger once the interval has passed flushes right away
+	advance(time.Hour)
+	dd.TriggerFlush()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&flushes) == 3 }, time.Second, time.Millisecond)
+}
+
+func TestReporter_TriggerFlushClosed(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+
+	var flushes int32
+	dd, _ := New(WithClient(&statsd.NoOpClient{}), WithRegistry(metrics.NewRegistry()),
+		WithMinFlushInterval(time.Hour),
+		WithOnFlush(func(FlushStats) { atomic.AddInt32(&flushes, 1) }))
+	dd.now = func() time.Time { return now }
+
+	dd.TriggerFlush()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&flushes) == 1 }, time.Second, time.Millisecond)
+
+	// A pending flush is cancelled by Close
+	dd.TriggerFlush()
+	assert.NoError(t, dd.Close())
+	dd.TriggerFlush()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&flushes))
+}
@@ -0,0 +1,51 @@
+package datadog
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// deadlineWriter writes statsd payloads to a connection, failing writes that
+// block for longer than the timeout, if any
+type deadlineWriter struct {
+	net.Conn
+	timeout time.Duration
+
+	mu  sync.Mutex
+	err error
+}
+
+// Write writes b to the connection, recording any error
+func (w *deadlineWriter) Write(b []byte) (int, error) {
+	if w.timeout > 0 {
+		w.Conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	}
+
+	n, err := w.Conn.Write(b)
+	if err != nil {
+		w.mu.Lock()
+		if w.err == nil {
+			w.err = err
+		}
+		w.mu.Unlock()
+	}
+
+	return n, err
+}
+
+// SetWriteTimeout is called by the statsd client with its own timeout, which
+// is ignored in favor of the reporter's
+func (w *deadlineWriter) SetWriteTimeout(time.Duration) error {
+	return nil
+}
+
+// Err returns and clears the first write error since the previous call
+func (w *deadlineWriter) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.err
+	w.err = nil
+	return err
+}
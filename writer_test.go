@@ -0,0 +1,100 @@
+package datadog
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadlineWriter_WriteBlocked(t *testing.T) {
+	cn, peer := net.Pipe()
+	defer peer.Close()
+
+	w := &deadlineWriter{Conn: cn, timeout: 10 * time.Millisecond}
+	assert.NoError(t, w.SetWriteTimeout(time.Second))
+
+	// Nothing reads from the pipe, so the write blocks
+	start := time.Now()
+	_, err := w.Write([]byte("foo:1|c\n"))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	assert.ErrorIs(t, w.Err(), os.ErrDeadlineExceeded)
+	assert.NoError(t, w.Err())
+}
+
+func TestNew_WithWriteTimeout(t *testing.T) {
+	ch := newServer(t, 1)
+
+	r := newRegistryWithCounter("foo", 1)
+	dd, err := New(WithAddress(addr), WithRegistry(r), WithWriteTimeout(time.Second))
+	assert.NoError(t, err)
+	assert.Len(t, dd.ws, 1)
+
+	assert.NoError(t, dd.Flush())
+	assert.Equal(t, []string{"foo:1|c"}, receive(t, ch, 1))
+}
+
+func TestNew_WithConn(t *testing.T) {
+	cn, peer := net.Pipe()
+
+	ch := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 1024)
+		n, _ := peer.Read(buf)
+		ch <- string(buf[:n])
+		io.Copy(io.Discard, peer)
+	}()
+
+	r := newRegistryWithCounter("foo", 1)
+	dd, err := New(WithConn(cn), WithRegistry(r), WithPrefix("app"))
+	assert.NoError(t, err)
+	assert.Contains(t, dd.String(), "addr=conn pipe")
+
+	assert.NoError(t, dd.Flush())
+	assert.Equal(t, "app.foo:1|c\n", <-ch)
+
+	// Closing the reporter closes the connection
+	assert.NoError(t, dd.Close())
+	_, err = cn.Write([]byte("foo:1|c\n"))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+}
+
+func TestReporter_FlushWithWriteTimeout(t *testing.T) {
+	cn, peer := net.Pipe()
+	defer peer.Close()
+
+	// Nothing reads from the pipe, as with a full socket buffer, so the flush
+	// fails once the write times out rather than blocking
+	r := newRegistryWithCounter("foo", 1)
+	dd, err := New(WithConn(cn), WithRegistry(r), WithWriteTimeout(10*time.Millisecond))
+	assert.NoError(t, err)
+
+	start := time.Now()
+	assert.ErrorIs(t, dd.Flush(), os.ErrDeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+// addrlessConn is a connection without a remote address, as some custom
+// connections are
+type addrlessConn struct {
+	net.Conn
+}
+
+func (c addrlessConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+func TestReporter_StringWithConnWithoutAddress(t *testing.T) {
+	cn, peer := net.Pipe()
+	defer peer.Close()
+
+	dd, err := New(WithConn(addrlessConn{cn}), WithRegistry(metrics.NewRegistry()))
+	assert.NoError(t, err)
+	assert.Contains(t, dd.String(), "addr=conn datadog.addrlessConn")
+}